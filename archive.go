@@ -0,0 +1,426 @@
+package backedup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// archiveConfigName is the config file in an archive, it comes first.
+	archiveConfigName = "config.yaml"
+	// archiveBackupDir is the directory in an archive with the content of
+	// the backup directory.
+	archiveBackupDir = "backup_to"
+)
+
+// ArchiveFormat is the file format of an exported backup set.
+type ArchiveFormat string
+
+const (
+	// FormatTarGz is a gzip compressed tar file.
+	FormatTarGz ArchiveFormat = "tar.gz"
+	// FormatZip is a zip file.
+	FormatZip ArchiveFormat = "zip"
+)
+
+// ArchiveFormatOf returns the format for a file name by its extension, "-"
+// for stdin or stdout is FormatTarGz.
+func ArchiveFormatOf(name string) (ArchiveFormat, error) {
+	switch {
+	case name == "-", strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return FormatTarGz, nil
+	case strings.HasSuffix(name, ".zip"):
+		return FormatZip, nil
+	}
+	return "", fmt.Errorf("unknown archive format of %s, use .tar.gz, .tgz or .zip", name)
+}
+
+// archiveEntry is a file, directory or symlink in an archive.
+type archiveEntry struct {
+	// name is the path in the archive with / separators.
+	name string
+	// mode has the type and permission bits.
+	mode  os.FileMode
+	mtime time.Time
+	size  int64
+	// target is set for symlinks.
+	target string
+}
+
+// archiveWriter adds entries to an archive.
+type archiveWriter interface {
+	// add adds an entry, r is the content of a regular file.
+	add(e archiveEntry, r io.Reader) error
+	Close() error
+}
+
+// tarGzWriter writes FormatTarGz.
+type tarGzWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (w *tarGzWriter) add(e archiveEntry, r io.Reader) error {
+	hdr := &tar.Header{Name: e.name, Mode: int64(e.mode.Perm()), ModTime: e.mtime, Format: tar.FormatPAX}
+	switch {
+	case e.mode&os.ModeSymlink != 0:
+		hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.target
+	case e.mode.IsDir():
+		hdr.Typeflag, hdr.Name = tar.TypeDir, e.name+"/"
+	default:
+		hdr.Typeflag, hdr.Size = tar.TypeReg, e.size
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if r != nil {
+		_, err := io.Copy(w.tw, r)
+		return err
+	}
+	return nil
+}
+
+func (w *tarGzWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// zipWriter writes FormatZip.
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipWriter) add(e archiveEntry, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: e.mtime}
+	hdr.SetMode(e.mode.Perm() | e.mode&(os.ModeSymlink|os.ModeDir))
+	if e.mode.IsDir() {
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+	}
+	f, err := w.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if e.mode&os.ModeSymlink != 0 {
+		// like the zip tool, the content of a symlink is its target.
+		r = strings.NewReader(e.target)
+	}
+	if r != nil {
+		_, err = io.Copy(f, r)
+	}
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+// newArchiveWriter returns a writer of format to w.
+func newArchiveWriter(w io.Writer, format ArchiveFormat) (archiveWriter, error) {
+	switch format {
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}, nil
+	case FormatZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format %q", format)
+}
+
+// Export writes the config and the content of the storage to an archive.
+// The files backedup keeps for itself, like snapshots, are left out.
+func (b *Backedup) Export(w io.Writer, format ArchiveFormat) error {
+	if err := b.checkStorage(); err != nil {
+		return err
+	}
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	conf, err := afero.ReadFile(b.fs, b.ConfPath)
+	if err != nil {
+		return err
+	}
+	e := archiveEntry{name: archiveConfigName, mode: 0644, mtime: time.Now(), size: int64(len(conf))}
+	if err := aw.add(e, bytes.NewReader(conf)); err != nil {
+		return err
+	}
+	objects, err := b.storage.List("")
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if internalKey(o.Key) {
+			continue
+		}
+		if !o.Mode.IsDir() {
+			// the listings of some storages have no modes and targets.
+			if o, err = b.storage.Stat(o.Key); err != nil {
+				return err
+			}
+		}
+		e := archiveEntry{name: path.Join(archiveBackupDir, o.Key), mode: o.Mode, mtime: o.ModTime, size: o.Size, target: o.Target}
+		switch {
+		case o.Mode&os.ModeSymlink != 0, o.Mode.IsDir():
+			err = aw.add(e, nil)
+		case o.Mode.IsRegular():
+			err = b.exportObject(aw, e, o.Key)
+		default:
+			fmt.Fprintf(b.logger, "WARN: %s skipped, not a regular file\n", o.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// exportObject adds the content of key to aw as e.
+func (b *Backedup) exportObject(aw archiveWriter, e archiveEntry, key string) error {
+	rc, err := b.storage.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return aw.add(e, rc)
+}
+
+// archiveReader reads the entries of an archive in order.
+type archiveReader interface {
+	// next returns the next entry and a reader of its content, io.EOF at
+	// the end.
+	next() (archiveEntry, io.Reader, error)
+}
+
+// tarGzReader reads FormatTarGz.
+type tarGzReader struct {
+	tr *tar.Reader
+}
+
+func (r *tarGzReader) next() (archiveEntry, io.Reader, error) {
+	for {
+		hdr, err := r.tr.Next()
+		if err != nil {
+			return archiveEntry{}, nil, err
+		}
+		e := archiveEntry{name: strings.TrimSuffix(hdr.Name, "/"), mode: os.FileMode(hdr.Mode).Perm(), mtime: hdr.ModTime, size: hdr.Size}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			e.mode |= os.ModeSymlink
+			e.target = hdr.Linkname
+		case tar.TypeDir:
+			e.mode |= os.ModeDir
+		case tar.TypeReg:
+		default:
+			// hard links, devices and the like aren't written by Export.
+			continue
+		}
+		return e, r.tr, nil
+	}
+}
+
+// zipReader reads FormatZip.
+type zipReader struct {
+	files []*zip.File
+}
+
+func (r *zipReader) next() (archiveEntry, io.Reader, error) {
+	if len(r.files) == 0 {
+		return archiveEntry{}, nil, io.EOF
+	}
+	f := r.files[0]
+	r.files = r.files[1:]
+	e := archiveEntry{name: strings.TrimSuffix(f.Name, "/"), mode: f.Mode(), mtime: f.Modified, size: int64(f.UncompressedSize64)}
+	if e.mode.IsDir() {
+		return e, nil, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return e, nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return e, nil, fmt.Errorf("%s %s", f.Name, err)
+	}
+	if e.mode&os.ModeSymlink != 0 {
+		e.target = string(data)
+	}
+	return e, bytes.NewReader(data), nil
+}
+
+// newArchiveReader returns a reader of format from r. A zip file has its
+// index at the end, it is read into memory first.
+func newArchiveReader(r io.Reader, format ArchiveFormat) (archiveReader, error) {
+	switch format {
+	case FormatTarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &tarGzReader{tr: tar.NewReader(gz)}, nil
+	case FormatZip:
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		return &zipReader{files: zr.File}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format %q", format)
+}
+
+// Import unpacks an archive written by Export. The config of the archive is
+// written to confPath unless there is a config already, the backup set is
+// unpacked into the storage of the config at confPath, which has to be
+// empty. It returns where the storage is, the backup directory unless
+// backup_to is a URL.
+func Import(fs FS, r io.Reader, format ArchiveFormat, logger io.Writer, confPath string) (string, error) {
+	confPath, err := expandConfPath(confPath)
+	if err != nil {
+		return "", err
+	}
+	ar, err := newArchiveReader(r, format)
+	if err != nil {
+		return "", err
+	}
+	e, content, err := ar.next()
+	if err != nil {
+		return "", fmt.Errorf("reading archive %s", err)
+	}
+	if e.name != archiveConfigName {
+		return "", fmt.Errorf("not a backedup archive, %s has to come first", archiveConfigName)
+	}
+	conf, err := ioutil.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	exists, err := afero.Exists(fs, confPath)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		fmt.Fprintf(logger, "keeping the config %s\n", confPath)
+		if conf, err = afero.ReadFile(fs, confPath); err != nil {
+			return "", err
+		}
+	}
+	// the config is checked like New does before it is written.
+	b, err := newBackedup(fs, bufio.NewReader(strings.NewReader("")), logger, confPath, conf)
+	if err != nil {
+		return "", err
+	}
+	if b.Config.BackupTo == "" {
+		return "", fmt.Errorf("%s has no backup_to", confPath)
+	}
+	if !exists {
+		if err := afero.WriteFile(fs, confPath, conf, 0644); err != nil {
+			return "", err
+		}
+	}
+	storageTo := b.Config.BackupTo
+	if b.Config.remote != "" {
+		storageTo = b.Config.remote
+	}
+	if err := fs.MkdirAll(b.Config.BackupTo, 0755); err != nil {
+		return storageTo, err
+	}
+	// a running watch or sync can't change the storage meanwhile.
+	unlock, err := b.storage.Lock()
+	if err != nil {
+		return storageTo, err
+	}
+	err = b.unpack(ar, storageTo)
+	if uerr := unlock(); uerr != nil && err == nil {
+		err = uerr
+	}
+	return storageTo, err
+}
+
+// unpack puts the backup set of an archive into the storage, which has to
+// be empty, and writes its manifest.
+func (b *Backedup) unpack(ar archiveReader, storageTo string) error {
+	objects, err := b.storage.List("")
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if !internalKey(o.Key) && !o.Mode.IsDir() {
+			return fmt.Errorf("%s is not empty", storageTo)
+		}
+	}
+	// symlinks are created after the files so nothing is written through
+	// one, directory times change while they are filled, they are set last.
+	dirs, links := []ObjectInfo{}, []ObjectInfo{}
+	// the keys of the symlinks and of everything else with their parents,
+	// an entry can't be both or be inside a symlink.
+	linked, seen := map[string]bool{}, map[string]bool{}
+	for {
+		e, content, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading archive %s", err)
+		}
+		rel := strings.TrimPrefix(e.name, archiveBackupDir+"/")
+		if rel == e.name || rel == "" || path.IsAbs(rel) || strings.HasPrefix(path.Clean(rel), "../") || path.Clean(rel) == ".." {
+			return fmt.Errorf("invalid archive entry %s", e.name)
+		}
+		info := ObjectInfo{Key: path.Clean(rel), Size: e.size, Mode: e.mode, ModTime: e.mtime, Target: e.target}
+		symlink := e.mode&os.ModeSymlink != 0
+		if symlink && seen[info.Key] {
+			return fmt.Errorf("invalid archive entry %s, duplicate path", e.name)
+		}
+		parent := info.Key
+		if symlink {
+			linked[info.Key] = true
+			parent = path.Dir(info.Key)
+		}
+		for ; parent != "."; parent = path.Dir(parent) {
+			if linked[parent] {
+				return fmt.Errorf("invalid archive entry %s, %s is a symlink", e.name, path.Join(archiveBackupDir, parent))
+			}
+			seen[parent] = true
+		}
+		switch {
+		case e.mode.IsDir():
+			dirs = append(dirs, info)
+		case symlink:
+			links = append(links, info)
+		default:
+			if err := b.storage.Put(info, content); err != nil {
+				return err
+			}
+		}
+	}
+	for _, info := range links {
+		if err := b.storage.Put(info, nil); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := b.storage.Put(dirs[i], nil); err != nil {
+			return err
+		}
+	}
+	// the manifest of the archive is as old as the last run that wrote it.
+	return b.writeManifest()
+}
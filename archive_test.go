@@ -0,0 +1,161 @@
+package backedup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []ArchiveFormat{FormatTarGz, FormatZip} {
+		t.Run(string(format), func(t *testing.T) {
+			testExportImport(t, format)
+		})
+	}
+}
+
+func testExportImport(t *testing.T, format ArchiveFormat) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.netrc
+  - $HOME/.vim`)
+	defer cleanup()
+	netrc := b.Config.Paths[0].Path
+	vim := b.Config.Paths[1].Path
+	err := afero.WriteFile(b.fs, netrc, []byte("machine"), 0600)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(vim, "vimrc"), []byte("set nu"), 0644)
+	Ok(t, err)
+	err = b.fs.Symlink("vimrc", filepath.Join(vim, "init.vim"))
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+	mtime := time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC)
+	for _, path := range []string{b.backupPath(netrc), filepath.Join(b.backupPath(vim), "vimrc"), b.backupPath(vim)} {
+		err = b.fs.Chtimes(path, mtime, mtime)
+		Ok(t, err)
+	}
+	_, err = b.Snapshot()
+	Ok(t, err)
+
+	var buf bytes.Buffer
+	err = b.Export(&buf, format)
+	Ok(t, err)
+
+	fs := NewMemFs()
+	var logger bytes.Buffer
+	backupTo, err := Import(fs, bytes.NewReader(buf.Bytes()), format, &logger, b.ConfPath)
+	Ok(t, err)
+	Equals(t, b.Config.BackupTo, backupTo)
+	conf, err := afero.ReadFile(b.fs, b.ConfPath)
+	Ok(t, err)
+	Equals(t, string(conf), readString(t, fs, b.ConfPath))
+	Equals(t, "machine", readString(t, fs, b.backupPath(netrc)))
+	fi, err := fs.Stat(b.backupPath(netrc))
+	Ok(t, err)
+	Equals(t, "-rw-------", fi.Mode().Perm().String())
+	Equals(t, mtime, fi.ModTime().UTC())
+	fi, err = fs.Stat(b.backupPath(vim))
+	Ok(t, err)
+	Equals(t, mtime, fi.ModTime().UTC())
+	target, err := fs.Readlink(filepath.Join(b.backupPath(vim), "init.vim"))
+	Ok(t, err)
+	Equals(t, "vimrc", target)
+	// snapshots stay behind.
+	_, err = fs.Stat(b.snapshotsDir())
+	Equals(t, true, err != nil)
+
+	// a second import doesn't touch the backup or the config.
+	_, err = Import(fs, bytes.NewReader(buf.Bytes()), format, &logger, b.ConfPath)
+	Equals(t, fmt.Sprintf("%s is not empty", backupTo), fmt.Sprint(err))
+	Equals(t, "keeping the config "+b.ConfPath+"\n", logger.String())
+}
+
+func TestArchiveFormatOf(t *testing.T) {
+	for name, exp := range map[string]ArchiveFormat{"-": FormatTarGz, "a.tar.gz": FormatTarGz, "a.tgz": FormatTarGz, "a.zip": FormatZip} {
+		format, err := ArchiveFormatOf(name)
+		Ok(t, err)
+		Equals(t, exp, format)
+	}
+	_, err := ArchiveFormatOf("a.rar")
+	Equals(t, "unknown archive format of a.rar, use .tar.gz, .tgz or .zip", fmt.Sprint(err))
+}
+
+func TestImportSymlinkEscape(t *testing.T) {
+	fs := NewOsFs()
+	tmpDir, err := afero.TempDir(fs, "", "")
+	Ok(t, err)
+	defer fs.RemoveAll(tmpDir)
+	outside := filepath.Join(tmpDir, "outside")
+	err = fs.MkdirAll(outside, 0755)
+	Ok(t, err)
+	conf := fmt.Sprintf("backup_to: %s/backedup\npaths: []\n", tmpDir)
+	for name, entries := range map[string][]archiveEntry{
+		"invalid archive entry backup_to/x/file, backup_to/x is a symlink": {
+			{name: "backup_to/x", mode: os.ModeSymlink | 0777, target: outside},
+			{name: "backup_to/x/file", mode: 0644, size: 3},
+		},
+		"invalid archive entry backup_to/x, duplicate path": {
+			{name: "backup_to/x/file", mode: 0644, size: 3},
+			{name: "backup_to/x", mode: os.ModeSymlink | 0777, target: outside},
+		},
+	} {
+		var buf bytes.Buffer
+		aw, err := newArchiveWriter(&buf, FormatTarGz)
+		Ok(t, err)
+		err = aw.add(archiveEntry{name: archiveConfigName, mode: 0644, size: int64(len(conf))}, strings.NewReader(conf))
+		Ok(t, err)
+		for _, e := range entries {
+			var r io.Reader
+			if e.target == "" {
+				r = strings.NewReader("bad")
+			}
+			err = aw.add(e, r)
+			Ok(t, err)
+		}
+		Ok(t, aw.Close())
+		err = fs.RemoveAll(filepath.Join(tmpDir, "backedup"))
+		Ok(t, err)
+
+		_, err = Import(fs, &buf, FormatTarGz, ioutil.Discard, filepath.Join(tmpDir, ".backedup.yaml"))
+		Equals(t, name, fmt.Sprint(err))
+		_, err = fs.Lstat(filepath.Join(outside, "file"))
+		Equals(t, true, os.IsNotExist(err))
+	}
+}
+
+func TestImportChecks(t *testing.T) {
+	fs := NewMemFs()
+	archive := func(conf string) *bytes.Buffer {
+		var buf bytes.Buffer
+		aw, err := newArchiveWriter(&buf, FormatTarGz)
+		Ok(t, err)
+		err = aw.add(archiveEntry{name: archiveConfigName, mode: 0644, size: int64(len(conf))}, strings.NewReader(conf))
+		Ok(t, err)
+		Ok(t, aw.Close())
+		return &buf
+	}
+
+	// a config that New would refuse isn't written.
+	_, err := Import(fs, archive("backup_to: /backedup\nconflict: nope\n"), FormatTarGz, ioutil.Discard, "/conf.yaml")
+	Equals(t, `unknown conflict policy "nope"`, fmt.Sprint(err))
+	exists, err := afero.Exists(fs, "/conf.yaml")
+	Ok(t, err)
+	Equals(t, false, exists)
+
+	// another run holds the lock of the storage.
+	err = afero.WriteFile(fs, filepath.Join("/backedup", lockKey), []byte("other"), 0644)
+	Ok(t, err)
+	_, err = Import(fs, archive("backup_to: /backedup\npaths: []\n"), FormatTarGz, ioutil.Discard, "/conf.yaml")
+	Equals(t, true, errors.Is(err, ErrLocked))
+}
@@ -1,20 +1,25 @@
 package backedup
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/afero"
+	"golang.org/x/term"
 	"gopkg.in/yaml.v2"
 )
 
 const (
 	backupHomeDirName = "_HOME"
+	// origSuffix is added to existing files moved aside by ConflictBackup.
+	origSuffix = ".backedup-orig"
 )
 
 var (
@@ -22,272 +27,727 @@ var (
 	ErrNoDefaultConfig = errors.New("no default config")
 	// ErrDefaultConfigNotCreated for errors creating the default config
 	ErrDefaultConfigNotCreated = errors.New("config not created")
+	// ErrSymlinkExists when a path is already a symlink to somewhere else
+	ErrSymlinkExists = errors.New("symlink exists")
+	// ErrFileExists when a path already exists and is not a symlink
+	ErrFileExists = errors.New("file exists")
+	// ErrNotSymlink when a path is expected to be a symlink but is not
+	ErrNotSymlink = errors.New("file exists, not symlink")
+	// ErrJournalExists when a previous run was interrupted and has to be
+	// recovered first
+	ErrJournalExists = errors.New("interrupted journal found")
+	// ErrSyncConflict when a copy mode file changed locally and in the
+	// backup since the last sync
+	ErrSyncConflict = errors.New("changed locally and in the backup")
+	// ErrNotEncrypted when decrypting a file that backedup didn't encrypt
+	ErrNotEncrypted = errors.New("not an encrypted file")
+	// ErrDecrypt when a file can't be decrypted, because the key is wrong
+	// or the file was changed
+	ErrDecrypt = errors.New("can't decrypt, wrong key or corrupted file")
+	// ErrSecretFound when a path to back up contains what looks like a
+	// secret
+	ErrSecretFound = errors.New("possible secret found")
+	// ErrLocked when another run is changing the storage
+	ErrLocked = errors.New("storage is locked by another run")
+	// ErrNoManifest when the backup has no manifest to verify against
+	ErrNoManifest = errors.New("no manifest, run -backup first")
+	// ErrNoPassphrase when encrypted paths need a passphrase that can't be
+	// asked for
+	ErrNoPassphrase = errors.New("no passphrase, set key_file or " + PassphraseEnv)
 )
 
 // Backedup will handle the backing up of files.
 type Backedup struct {
 	ConfPath string
 	Config   *Config
+	// Tags limits every operation to the paths with one of these tags, all
+	// paths are used if it is empty.
+	Tags []string
+	// NoPrompt keeps the passphrase of encrypted paths from being asked for,
+	// for runs that only look like -dry-run and -status.
+	NoPrompt bool
 	homeDir  string
-	fs       afero.Fs
+	hostname string
+	fs       FS
 	logger   io.Writer
-	stdin    io.Reader
+	stdin    *bufio.Reader
+	// tty is stdin if it is a terminal, passphrases are read from it
+	// without echo.
+	tty *os.File
+	// appPaths are the paths of Config.Apps.
+	appPaths []PathConfig
+	// profile is the name of the selected profile.
+	profile string
+	// crypt is created on first use of an encrypted path.
+	crypt *crypter
+	// storage keeps copy mode paths, see Config.Storage.
+	storage Storage
+	// etags is loaded on first use, see etagCache.
+	etags *etagCache
 }
 
 // New will initialize a new Backedup configuration. If the input configuration file
 // path is not found, it will prompt for creating a new default one.
-func New(fs afero.Fs, stdin io.Reader, logger io.Writer, confPath string) (*Backedup, error) {
+func New(fs FS, stdin io.Reader, logger io.Writer, confPath string) (*Backedup, error) {
+	confPath, err := expandConfPath(confPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reader is shared by every prompt so no buffered input is lost.
+	reader := bufio.NewReader(stdin)
+	// check the conf path existance and prompt to create if not there.
+	if err := initConfig(fs, reader, logger, confPath); err != nil {
+		return nil, err
+	}
+	confData, err := afero.ReadFile(fs, confPath)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBackedup(fs, reader, logger, confPath, confData)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		b.tty = f
+	}
+	return b, nil
+}
+
+// expandConfPath expands $HOME in the path of the config, finding the home
+// directory if it isn't set.
+func expandConfPath(confPath string) (string, error) {
 	// get the users home directory for expanding $HOME in config.
 	if os.Getenv("HOME") == "" {
 		homeDir, err := homedir.Dir()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 		os.Setenv("HOME", filepath.Clean(homeDir))
 	}
 	// expand any $HOME environment variables.
-	confPath = os.ExpandEnv(confPath)
+	return os.ExpandEnv(confPath), nil
+}
 
-	// check the conf path existance and prompt to create if not there.
-	if err := initConfig(fs, stdin, logger, confPath); err != nil {
-		return nil, err
-	}
-	confData, err := afero.ReadFile(fs, confPath)
-	if err != nil {
+// newBackedup returns a Backedup for the config confData read from
+// confPath, with the host and home of this machine.
+func newBackedup(fs FS, reader *bufio.Reader, logger io.Writer, confPath string, confData []byte) (*Backedup, error) {
+	conf := &Config{}
+	if err := yaml.Unmarshal(confData, &conf); err != nil {
 		return nil, err
 	}
-	conf := &Config{}
-	if err = yaml.Unmarshal(confData, &conf); err != nil {
+	if err := conf.Validate(); err != nil {
 		return nil, err
 	}
 	conf.BackupTo = os.ExpandEnv(conf.BackupTo)
-	for i, path := range conf.Paths {
-		conf.Paths[i] = os.ExpandEnv(path)
+	storageTo := conf.remoteBackupTo()
+	conf.KeyFile = os.ExpandEnv(conf.KeyFile)
+	for i, exclude := range conf.Exclude {
+		conf.Exclude[i] = os.ExpandEnv(exclude)
+	}
+	for i, p := range conf.Paths {
+		conf.Paths[i] = p.expandEnv()
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
 	}
 
 	b := &Backedup{
 		Config:   conf,
 		ConfPath: confPath,
 		homeDir:  os.Getenv("HOME"),
+		hostname: hostname,
 		fs:       fs,
 		logger:   logger,
-		stdin:    stdin,
+		stdin:    reader,
+	}
+	if b.appPaths, err = b.loadApps(); err != nil {
+		return nil, err
+	}
+	if b.profile, err = conf.selectProfile("", hostname); err != nil {
+		return nil, err
+	}
+	if b.storage, err = openStorage(conf.Storage, fs, storageTo); err != nil {
+		return nil, err
 	}
 	return b, nil
 }
 
 // Backup moves files configured and creates symlinks to the backed up directory.
-// This should be done once on an initial run. NOTE Backup only works for the
-// case that fs is *afero.OsFs because due to lack of symlink support in afero.
+// This should be done once on an initial run.
 func (b *Backedup) Backup() error {
-	// create backup directory if it doesn't exist
-	if err := b.fs.MkdirAll(b.Config.BackupTo, 0755); err != nil {
+	plan, err := b.PlanBackup()
+	if err != nil {
 		return err
 	}
-	backupHomeDir := filepath.Join(b.Config.BackupTo, backupHomeDirName)
-	if err := b.fs.MkdirAll(backupHomeDir, 0755); err != nil {
+	// create backup directory if it doesn't exist
+	if err := b.fs.MkdirAll(filepath.Join(b.Config.BackupTo, backupHomeDirName), 0755); err != nil {
 		return err
 	}
-	// iterate config list of paths, checking for symlinks first, if not there
-	// move the current file and create a new symlink.
-PATH_LOOP:
-	for _, path := range b.Config.Paths {
-		var fi os.FileInfo
-		var err error
-		if fsOs, ok := b.fs.(*afero.OsFs); ok {
-			fi, _, err = fsOs.LstatIfPossible(path)
-		} else {
-			fi, err = os.Lstat(path)
+	err = b.run("backup", plan)
+	if serr := b.updateSyncState(); serr != nil && err == nil {
+		err = serr
+	}
+	if merr := b.writeManifest(); merr != nil && err == nil {
+		err = merr
+	}
+	return b.autoCommit("backup", err)
+}
+
+// PlanBackup returns the actions Backup would take without changing anything.
+// Each configured path that is not already a symlink is moved to the backup
+// directory and replaced by a symlink to it, copy mode paths are copied.
+func (b *Backedup) PlanBackup() (Plan, error) {
+	paths, err := b.resolvePaths(true, false)
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{}
+	for _, p := range paths {
+		// the permissions of copy mode paths are kept by the storage.
+		if b.planBackupPath(&plan, p) && (b.Config.mode(p) != ModeCopy || p.Template || p.Encrypt) {
+			b.planPerm(&plan, p, b.backupPath(p.Path))
+		}
+	}
+	return plan, nil
+}
+
+// planBackupPath adds the actions that back up a configured path, it
+// returns false if the path failed or doesn't exist.
+func (b *Backedup) planBackupPath(plan *Plan, p PathConfig) bool {
+	path := p.Path
+	fi, err := b.fs.Lstat(path)
+	if os.IsNotExist(err) && p.Optional {
+		plan.skip(path, "optional, doesn't exist")
+		return false
+	}
+	if err != nil {
+		plan.fail(path, err)
+		return false
+	}
+	if p.Template {
+		return b.planBackupTemplate(plan, p, fi)
+	}
+	if p.Encrypt {
+		return b.planBackupEncrypt(plan, p)
+	}
+	backupPath := b.backupPath(path)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		// skip symlink files
+		if target, _ := b.fs.Readlink(path); target == backupPath || target == b.restorePath(path) {
+			plan.skip(path, "already backed up")
+			return true
 		}
+		plan.fail(path, ErrSymlinkExists)
+		return false
+	}
+	if b.Config.mode(p) == ModeCopy {
+		return b.planBackupCopy(plan, p)
+	}
+	if err := b.checkSecrets(p); err != nil {
+		plan.fail(path, err)
+		return false
+	}
+	if fi.IsDir() {
+		m := b.excludes(p)
+		split, err := b.backupSplit(p, "", m)
 		if err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
+			plan.fail(path, err)
+			return false
 		}
-		if fi.Mode()&os.ModeSymlink != 0 {
-			// skip symlink files
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s symlink exists\n", path)))
-			continue PATH_LOOP
+		if split {
+			b.planBackupDir(plan, p, "", m)
+			return true
+		}
+	}
+	b.planBackupEntry(plan, p, path, backupPath)
+	return true
+}
+
+// planBackupCopy adds a put of every file of a copy mode path that isn't
+// excluded, it returns false if the path failed.
+func (b *Backedup) planBackupCopy(plan *Plan, p PathConfig) bool {
+	key := b.storageKey(b.backupPath(p.Path))
+	if objects, err := b.storage.List(key); err != nil {
+		plan.fail(p.Path, err)
+		return false
+	} else if len(objects) > 0 {
+		plan.skip(p.Path, "already backed up, use sync")
+		return true
+	}
+	if err := b.checkSecrets(p); err != nil {
+		plan.fail(p.Path, err)
+		return false
+	}
+	files, err := listFiles(b.fs, p.Path, b.excludes(p))
+	if err != nil {
+		plan.fail(p.Path, err)
+		return false
+	}
+	for _, rel := range unionFiles(files, nil) {
+		plan.add(ActionPut, p.Path, filepath.Join(p.Path, rel), objectKey(key, rel))
+	}
+	return true
+}
+
+// backupSplit reports whether the directory rel inside a configured path is
+// backed up entry by entry, because its files are linked one by one or it
+// has excluded entries.
+func (b *Backedup) backupSplit(p PathConfig, rel string, m *ignoreMatcher) (bool, error) {
+	if b.Config.mode(p) == ModeLinkFiles {
+		return true, nil
+	}
+	return hasIgnored(b.fs, p.Path, rel, m)
+}
+
+// planPerm adds a chmod of target if the path has a Perm that target
+// doesn't have yet. target is checked when the plan is applied if it
+// doesn't exist yet.
+func (b *Backedup) planPerm(plan *Plan, p PathConfig, target string) {
+	perm, ok, _ := p.perm()
+	if !ok {
+		return
+	}
+	if fi, err := b.fs.Stat(target); err == nil && fi.Mode().Perm() == perm {
+		return
+	}
+	*plan = append(*plan, Action{Type: ActionChmod, Path: p.Path, Dst: target, Perm: perm})
+}
+
+// planBackupEntry adds the actions that back up a single file or directory.
+func (b *Backedup) planBackupEntry(plan *Plan, p PathConfig, path, backupPath string) {
+	plan.add(ActionMove, path, path, backupPath)
+	plan.add(ActionSymlink, path, backupPath, path)
+}
+
+// planBackupDir backs up the entries of the directory rel inside a
+// configured path one by one, so the excluded ones stay local. Directories
+// with excluded entries are walked into.
+func (b *Backedup) planBackupDir(plan *Plan, p PathConfig, rel string, m *ignoreMatcher) {
+	dir := filepath.Join(p.Path, rel)
+	m = m.withFile(b.fs, dir, rel)
+	fis, err := afero.ReadDir(b.fs, dir)
+	if err != nil {
+		plan.fail(dir, err)
+		return
+	}
+	for _, fi := range fis {
+		childRel := filepath.Join(rel, fi.Name())
+		if m.match(childRel, fi.IsDir()) {
+			continue
 		}
-		// change home paths to $HOME/path
-		isHomeDir := false
-		if strings.HasPrefix(path, b.homeDir) {
-			isHomeDir = true
+		child := filepath.Join(p.Path, childRel)
+		backupChild := filepath.Join(b.backupPath(p.Path), childRel)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if target, _ := b.fs.Readlink(child); target == backupChild {
+				continue
+			}
 		}
 		if fi.IsDir() {
-			// handle directories
-			dirBackupName := filepath.Base(path)
-			dirBackupDir := filepath.Join(b.Config.BackupTo, filepath.Dir(path))
-			if isHomeDir {
-				dirBackupDir = filepath.Join(backupHomeDir, strings.Replace(filepath.Dir(path), b.homeDir, "", -1))
+			split, err := b.backupSplit(p, childRel, m)
+			if err != nil {
+				plan.fail(child, err)
+				continue
 			}
-			if err := b.fs.MkdirAll(dirBackupDir, 0755); err != nil {
-				b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-				continue PATH_LOOP
+			if split {
+				b.planBackupDir(plan, p, childRel, m)
+				continue
 			}
-			backupPath := filepath.Join(dirBackupDir, dirBackupName)
-			if err := b.fs.Rename(path, backupPath); err != nil {
-				b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-				continue PATH_LOOP
-			}
-			if err := os.Symlink(backupPath, path); err != nil {
-				b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			}
-			continue PATH_LOOP
-		}
-		// handle files
-		fileBackupName := filepath.Base(path)
-		fileBackupDir := backupHomeDir
-		if !isHomeDir {
-			fileBackupDir = filepath.Join(b.Config.BackupTo, filepath.Dir(path))
-		}
-		if err := b.fs.MkdirAll(fileBackupDir, 0755); err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
-		}
-		backupPath := filepath.Join(fileBackupDir, fileBackupName)
-		if err := b.fs.Rename(path, backupPath); err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
-		}
-		if err := os.Symlink(backupPath, path); err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
 		}
+		b.planBackupEntry(plan, p, child, backupChild)
 	}
+}
 
-	return nil
+// excludes returns the exclude rules of a configured path.
+func (b *Backedup) excludes(p PathConfig) *ignoreMatcher {
+	return newIgnoreMatcher(p.Path, append(append([]string{}, b.Config.Exclude...), p.Exclude...))
 }
 
-// Restore creates symlinks for previously backed up files.
+// Restore creates symlinks for previously backed up files. Copy mode paths
+// are copied from the backup.
 func (b *Backedup) Restore() error {
-	exists, err := afero.Exists(b.fs, b.Config.BackupTo)
+	plan, err := b.PlanRestore()
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return fmt.Errorf("%s does not exist", b.Config.BackupTo)
+	err = b.run("restore", plan)
+	if serr := b.updateSyncState(); serr != nil && err == nil {
+		return serr
 	}
-	backupHomeDir := filepath.Join(b.Config.BackupTo, backupHomeDirName)
-	if err := b.fs.MkdirAll(backupHomeDir, 0755); err != nil {
-		return err
+	return err
+}
+
+// PlanRestore returns the actions Restore would take without changing anything.
+func (b *Backedup) PlanRestore() (Plan, error) {
+	if err := b.checkStorage(); err != nil {
+		return nil, err
 	}
-PATH_LOOP:
-	for _, path := range b.Config.Paths {
-		exists, err := afero.Exists(b.fs, b.Config.BackupTo)
-		if err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
+	paths, err := b.resolvePaths(false, true)
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{}
+	for _, p := range paths {
+		backupPath := b.restorePath(p.Path)
+		if p.Template {
+			if b.planRestoreTemplate(&plan, p, backupPath) {
+				b.planPerm(&plan, p, p.Path)
+			}
+			continue
+		}
+		if p.Encrypt {
+			if b.planRestoreEncrypt(&plan, p, backupPath) {
+				b.planPerm(&plan, p, p.Path)
+			}
+			continue
 		}
-		if !exists {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: backup path doesn't exist %s\n", path)))
-			continue PATH_LOOP
+		if b.Config.mode(p) == ModeCopy {
+			if b.planRestoreCopy(&plan, p, b.restoreKey(p.Path)) {
+				b.planPerm(&plan, p, p.Path)
+			}
+			continue
 		}
+		if b.planRestorePath(&plan, p, backupPath) {
+			b.planPerm(&plan, p, backupPath)
+		}
+	}
+	return plan, nil
+}
 
-		isHomeDir := false
-		if strings.HasPrefix(path, b.homeDir) {
-			isHomeDir = true
+// planRestorePath adds the actions that link a configured path to its
+// backup, it returns false if the path failed or was left alone.
+func (b *Backedup) planRestorePath(plan *Plan, p PathConfig, backupPath string) bool {
+	path := p.Path
+	bfi, err := b.fs.Lstat(backupPath)
+	if err != nil {
+		if os.IsNotExist(err) && p.Optional {
+			plan.skip(path, "optional, not backed up")
+			return false
+		}
+		plan.fail(path, fmt.Errorf("backup path doesn't exist %s", backupPath))
+		return false
+	}
+	if bfi.IsDir() {
+		m := b.excludes(p)
+		split, err := b.restoreSplit(p, "", m)
+		if err != nil {
+			plan.fail(path, err)
+			return false
+		}
+		if split {
+			b.planRestoreDir(plan, p, "", m)
+			return true
+		}
+	}
+	fi, err := b.fs.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		plan.fail(path, err)
+		return false
+	}
+	if err == nil {
+		target := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, _ = b.fs.Readlink(path)
+			if target == backupPath {
+				plan.skip(path, "already linked")
+				return true
+			}
 		}
+		if !b.planConflict(plan, p, target) {
+			return false
+		}
+	}
+	// create the symlink from the backup path to path
+	plan.add(ActionSymlink, path, backupPath, path)
+	return true
+}
 
-		backupPath := ""
-		if isHomeDir {
-			backupPath = filepath.Join(backupHomeDir, strings.Replace(filepath.Dir(path), b.homeDir, "", -1))
-		} else {
-			backupPath = filepath.Join(b.Config.BackupTo, path)
+// restoreSplit reports whether the backed up directory rel inside a
+// configured path is restored by linking its entries one by one. That is
+// the case if its files are linked one by one, if it is a directory locally
+// already, or if there are exclude rules for it.
+func (b *Backedup) restoreSplit(p PathConfig, rel string, m *ignoreMatcher) (bool, error) {
+	if b.Config.mode(p) == ModeLinkFiles {
+		return true, nil
+	}
+	if fi, err := b.fs.Lstat(filepath.Join(p.Path, rel)); err == nil && fi.IsDir() {
+		return true, nil
+	}
+	if rel == "" && !m.empty() {
+		return true, nil
+	}
+	return hasIgnoreFile(b.fs, filepath.Join(b.restorePath(p.Path), rel))
+}
+
+// planRestoreDir links the backed up entries of the directory rel inside a
+// configured path one by one.
+func (b *Backedup) planRestoreDir(plan *Plan, p PathConfig, rel string, m *ignoreMatcher) {
+	backupDir := filepath.Join(b.restorePath(p.Path), rel)
+	m = m.withFile(b.fs, backupDir, rel)
+	fis, err := afero.ReadDir(b.fs, backupDir)
+	if err != nil {
+		plan.fail(filepath.Join(p.Path, rel), err)
+		return
+	}
+	for _, fi := range fis {
+		childRel := filepath.Join(rel, fi.Name())
+		if m.match(childRel, fi.IsDir()) {
+			continue
+		}
+		child := filepath.Join(p.Path, childRel)
+		backupChild := filepath.Join(backupDir, fi.Name())
+		lfi, err := b.fs.Lstat(child)
+		if err != nil && !os.IsNotExist(err) {
+			plan.fail(child, err)
+			continue
+		}
+		if fi.IsDir() {
+			split, err := b.restoreSplit(p, childRel, m)
+			if err != nil {
+				plan.fail(child, err)
+				continue
+			}
+			if split {
+				b.planRestoreDir(plan, p, childRel, m)
+				continue
+			}
 		}
+		if lfi != nil {
+			target := ""
+			if lfi.Mode()&os.ModeSymlink != 0 {
+				target, _ = b.fs.Readlink(child)
+				if target == backupChild {
+					continue
+				}
+			}
+			c := p
+			c.Path = child
+			if !b.planConflict(plan, c, target) {
+				continue
+			}
+		}
+		plan.add(ActionSymlink, child, backupChild, child)
+	}
+}
 
-		if err := b.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
+// planRestoreCopy adds the actions that copy a copy mode path from the key
+// of its backup, it returns false if the path failed or was left alone.
+func (b *Backedup) planRestoreCopy(plan *Plan, p PathConfig, key string) bool {
+	path, m := p.Path, b.excludes(p)
+	files, err := b.listObjects(key, m)
+	if err != nil {
+		plan.fail(path, err)
+		return false
+	}
+	if len(files) == 0 {
+		if p.Optional {
+			plan.skip(path, "optional, not backed up")
+			return false
 		}
+		plan.fail(path, fmt.Errorf("backup path doesn't exist %s", key))
+		return false
+	}
+	fi, err := b.fs.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		plan.fail(path, err)
+		return false
+	}
+	if err == nil {
+		target := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, _ = b.fs.Readlink(path)
+		} else if ok, err := b.inSync(path, key, m); err != nil {
+			plan.fail(path, err)
+			return false
+		} else if ok {
+			plan.skip(path, "up to date")
+			return true
+		}
+		if !b.planConflict(plan, p, target) {
+			return false
+		}
+	}
+	for _, rel := range unionFiles(files, nil) {
+		plan.add(ActionGet, path, objectKey(key, rel), filepath.Join(path, rel))
+	}
+	return true
+}
 
-		fmt.Println("creating symlink", backupPath, path)
-		// create the symlink from the backup path to path
-		if err := os.Symlink(backupPath, path); err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
+// planConflict adds the actions that clear an existing file at a path before
+// it is linked, according to the path's conflict policy. target is set if the
+// existing file is a symlink. It returns false if the path is skipped.
+func (b *Backedup) planConflict(plan *Plan, p PathConfig, target string) bool {
+	path := p.Path
+	switch b.Config.conflictPolicy(p) {
+	case ConflictSkip:
+		plan.skip(path, "file exists")
+		return false
+	case ConflictBackup:
+		plan.add(ActionMove, path, path, origPathOf(path))
+	case ConflictOverwrite:
+		plan.add(ActionRemove, path, target, path)
+	case ConflictPrompt:
+		// asked when the plan runs, so -dry-run doesn't wait on stdin.
+		plan.add(ActionPrompt, path, target, path)
+	default:
+		if target != "" {
+			plan.fail(path, ErrSymlinkExists)
+		} else {
+			plan.fail(path, ErrFileExists)
 		}
+		return false
 	}
+	return true
+}
 
-	return nil
+// origPathOf returns a timestamped path next to path to move an existing
+// file aside to.
+func origPathOf(path string) string {
+	return fmt.Sprintf("%s.%s%s", path, time.Now().Format("20060102150405"), origSuffix)
 }
 
 // Uninstall removes symlinks to backed up files and restores
 // the original files.
 func (b *Backedup) Uninstall() error {
-	exists, err := afero.Exists(b.fs, b.Config.BackupTo)
+	plan, err := b.PlanUninstall()
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return fmt.Errorf("%s does not exist", b.Config.BackupTo)
+	return b.run("uninstall", plan)
+}
+
+// PlanUninstall returns the actions Uninstall would take without changing
+// anything.
+func (b *Backedup) PlanUninstall() (Plan, error) {
+	if err := b.checkBackupTo(); err != nil {
+		return nil, err
 	}
-	backupHomeDir := filepath.Join(b.Config.BackupTo, backupHomeDirName)
-	if err := b.fs.MkdirAll(backupHomeDir, 0755); err != nil {
-		return err
+	paths, err := b.resolvePaths(true, false)
+	if err != nil {
+		return nil, err
 	}
-
-PATH_LOOP:
-	for _, path := range b.Config.Paths {
-		// check that the path is a symlink, remove it and move the backed up files
-		// to path
-		var fi os.FileInfo
-		var err error
-		if fsOs, ok := b.fs.(*afero.OsFs); ok {
-			fi, _, err = fsOs.LstatIfPossible(path)
-		} else {
-			fi, err = os.Lstat(path)
+	plan := Plan{}
+	for _, p := range paths {
+		path := p.Path
+		if b.Config.mode(p) == ModeCopy {
+			plan.skip(path, "copy mode")
+			continue
+		}
+		if p.Template {
+			plan.skip(path, "template")
+			continue
+		}
+		if p.Encrypt {
+			plan.skip(path, "encrypted")
+			continue
+		}
+		// check that the path is a symlink, remove it and copy the backed up
+		// files to path
+		fi, err := b.fs.Lstat(path)
+		if os.IsNotExist(err) && p.Optional {
+			plan.skip(path, "optional, doesn't exist")
+			continue
 		}
 		if err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
+			plan.fail(path, err)
+			continue
+		}
+		backupPath := b.restorePath(path)
+		if fi.IsDir() {
+			// a directory backed up entry by entry
+			b.planUninstallDir(&plan, path, backupPath)
+			continue
 		}
 		if fi.Mode()&os.ModeSymlink == 0 {
 			// skip non symlink files
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s file exists, not symlink\n", path)))
-			continue PATH_LOOP
+			plan.fail(path, ErrNotSymlink)
+			continue
 		}
-		// remove the current path symlink
-		if err := os.Remove(path); err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
-		}
-
-		// move backed up data to path
-		isHomeDir := false
-		if strings.HasPrefix(path, b.homeDir) {
-			isHomeDir = true
+		if _, err := b.fs.Lstat(backupPath); err != nil {
+			plan.fail(path, err)
+			continue
 		}
-		backupPath := ""
-		if isHomeDir {
-			backupPath = filepath.Join(backupHomeDir, strings.Replace(path, b.homeDir, "", -1))
-		} else {
-			backupPath = filepath.Join(b.Config.BackupTo, path)
+		target, err := b.fs.Readlink(path)
+		if err != nil {
+			plan.fail(path, err)
+			continue
 		}
+		plan.add(ActionRemove, path, target, path)
+		plan.add(ActionCopy, path, backupPath, path)
+		b.planPerm(&plan, p, path)
+	}
+	return plan, nil
+}
 
-		if fsOs, ok := b.fs.(*afero.OsFs); ok {
-			fi, _, err = fsOs.LstatIfPossible(backupPath)
-		} else {
-			fi, err = os.Lstat(backupPath)
+// planUninstallDir restores the entries of a directory that were backed up
+// one by one.
+func (b *Backedup) planUninstallDir(plan *Plan, dir, backupDir string) {
+	fis, err := afero.ReadDir(b.fs, dir)
+	if err != nil {
+		plan.fail(dir, err)
+		return
+	}
+	for _, fi := range fis {
+		child := filepath.Join(dir, fi.Name())
+		backupChild := filepath.Join(backupDir, fi.Name())
+		if fi.IsDir() {
+			b.planUninstallDir(plan, child, backupChild)
+			continue
 		}
-		if err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
 		}
-
-		if err := b.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
-			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			continue PATH_LOOP
+		if target, _ := b.fs.Readlink(child); target == backupChild {
+			plan.add(ActionRemove, child, target, child)
+			plan.add(ActionCopy, child, backupChild, child)
 		}
+	}
+}
 
-		if fi.IsDir() {
-			if err := DirCopy(backupPath, path); err != nil {
-				b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			}
-		} else {
-			if err := FileCopy(backupPath, path); err != nil {
-				b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
-			}
-		}
+// run applies plan holding the lock of the storage and names the operation
+// in the returned *MultiError.
+func (b *Backedup) run(op string, plan Plan) error {
+	unlock, err := b.storage.Lock()
+	if err != nil {
+		return err
+	}
+	err = b.applyOp(op, plan)
+	if uerr := unlock(); uerr != nil && err == nil {
+		return uerr
+	}
+	return err
+}
+
+// applyOp applies the plan of the operation op, the caller holds the lock
+// of the storage.
+func (b *Backedup) applyOp(op string, plan Plan) error {
+	err := b.Apply(plan)
+	if errs, ok := err.(*MultiError); ok {
+		errs.Op = op
 	}
+	return err
+}
 
+// checkBackupTo returns an error if the backup directory is missing.
+func (b *Backedup) checkBackupTo() error {
+	exists, err := afero.Exists(b.fs, b.Config.BackupTo)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%s does not exist", b.Config.BackupTo)
+	}
 	return nil
 }
+
+// backupPath returns where path is kept inside the backup directory. Paths
+// under the home directory are stored relative to _HOME so they can be
+// restored for a different user.
+func (b *Backedup) backupPath(path string) string {
+	if path == b.homeDir || strings.HasPrefix(path, b.homeDir+string(filepath.Separator)) {
+		return filepath.Join(b.Config.BackupTo, backupHomeDirName, strings.TrimPrefix(path, b.homeDir))
+	}
+	return filepath.Join(b.Config.BackupTo, path)
+}
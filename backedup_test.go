@@ -2,6 +2,7 @@ package backedup
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -60,7 +61,7 @@ func getFs(fs afero.Fs, dir string) []string {
 func TestNew(t *testing.T) {
 	var stdin bytes.Buffer
 	var logger bytes.Buffer
-	fs := afero.NewMemMapFs()
+	fs := NewMemFs()
 	confPath := "/tmp/.backedup.yaml"
 	err := afero.WriteFile(fs, confPath, []byte(DefaultCfg), 0644)
 	Ok(t, err)
@@ -70,40 +71,63 @@ func TestNew(t *testing.T) {
 	want := &Config{}
 	yaml.Unmarshal([]byte(DefaultCfg), want)
 	want.BackupTo = os.ExpandEnv(want.BackupTo)
-	for i, path := range want.Paths {
-		want.Paths[i] = os.ExpandEnv(path)
+	for i, p := range want.Paths {
+		want.Paths[i].Path = os.ExpandEnv(p.Path)
 	}
 	Equals(t, want, b.Config)
 }
 
-func checkNewSymlink(t *testing.T, fs *afero.OsFs, path string) {
+func checkNewSymlink(t *testing.T, fs FS, path string) {
 	exists, err := afero.Exists(fs, path)
 	Ok(t, err)
 	Equals(t, true, exists, "path not found "+path)
 	// symlink should be there pointing to moved file
-	fi, _, err := fs.LstatIfPossible(path)
+	fi, err := fs.Lstat(path)
 	Ok(t, err)
 	if fi.Mode()&os.ModeSymlink == 0 {
 		t.Fatalf("%s is not a symlink", path)
 	}
 }
 
-func checkNotSymlink(t *testing.T, fs *afero.OsFs, path string) {
+func checkNotSymlink(t *testing.T, fs FS, path string) {
 	exists, err := afero.Exists(fs, path)
 	Ok(t, err)
 	Equals(t, true, exists, "path not found "+path)
 	// symlink should be there pointing to moved file
-	fi, _, err := fs.LstatIfPossible(path)
+	fi, err := fs.Lstat(path)
 	Ok(t, err)
 	if fi.Mode()&os.ModeSymlink != 0 {
 		t.Fatalf("%s is a symlink", path)
 	}
 }
+
+// checkFailedPaths fails the test unless err is a *MultiError for exactly
+// paths.
+func checkFailedPaths(t *testing.T, err error, paths ...string) {
+	var errs *MultiError
+	if !errors.As(err, &errs) {
+		t.Fatalf("%v is not a *MultiError", err)
+	}
+	failed := []string{}
+	for _, err := range errs.Errors {
+		failed = append(failed, err.Path)
+	}
+	Equals(t, paths, failed)
+	Equals(t, len(paths) < errs.Total, errs.Partial())
+}
+
 func TestBackupRestoreUninstall(t *testing.T) {
+	testBackupRestoreUninstall(t, NewOsFs())
+}
+
+func TestBackupRestoreUninstallMem(t *testing.T) {
+	testBackupRestoreUninstall(t, NewMemFs())
+}
+
+func testBackupRestoreUninstall(t *testing.T, fs FS) {
 	var stdin bytes.Buffer
 	// var logger bytes.Buffer
 	logger := os.Stderr
-	fs := afero.NewOsFs()
 	tmpDir, err := afero.TempDir(fs, "", "")
 	Ok(t, err)
 	defer fs.RemoveAll(tmpDir)
@@ -138,9 +162,9 @@ func TestBackupRestoreUninstall(t *testing.T) {
 
 	// create a symlink file that shouldn't be backed up
 	symlink := filepath.Join(tmpDir, ".symlink")
-	err = os.Symlink(tmpDir, symlink)
+	err = fs.Symlink(tmpDir, symlink)
 	Ok(t, err)
-	defer os.Remove(symlink)
+	defer fs.Remove(symlink)
 
 	backupTo := filepath.Join(tmpDir, "backedup")
 
@@ -160,8 +184,10 @@ paths:
 
 	b, err := New(fs, &stdin, logger, confPath)
 	Ok(t, err)
+	// the symlink is the only path that fails.
 	err = b.Backup()
-	Ok(t, err)
+	checkFailedPaths(t, err, symlink)
+	Equals(t, true, errors.Is(err, ErrSymlinkExists))
 
 	exists, err := afero.Exists(fs, backupTo)
 	Ok(t, err)
@@ -170,57 +196,256 @@ paths:
 	exists, err = afero.Exists(fs, filepath.Join(backupTo, dir))
 	Ok(t, err)
 	Equals(t, true, exists)
-	checkNewSymlink(t, fs.(*afero.OsFs), dir)
+	checkNewSymlink(t, fs, dir)
 
 	exists, err = afero.Exists(fs, filepath.Join(backupTo, filepath.Join(backupHomeDirName, ".dirhome")))
 	Ok(t, err)
 	Equals(t, true, exists)
-	checkNewSymlink(t, fs.(*afero.OsFs), dirhome)
+	checkNewSymlink(t, fs, dirhome)
 
 	exists, err = afero.Exists(fs, filepath.Join(backupTo, filepath.Join(backupHomeDirName, ".filehome")))
 	Ok(t, err)
 	Equals(t, true, exists)
-	checkNewSymlink(t, fs.(*afero.OsFs), filehome)
+	checkNewSymlink(t, fs, filehome)
 
 	exists, err = afero.Exists(fs, filepath.Join(backupTo, file1))
 	Ok(t, err)
 	Equals(t, true, exists)
-	checkNewSymlink(t, fs.(*afero.OsFs), file1)
+	checkNewSymlink(t, fs, file1)
 
 	exists, err = afero.Exists(fs, filepath.Join(backupTo, file2))
 	Ok(t, err)
 	Equals(t, true, exists)
-	checkNewSymlink(t, fs.(*afero.OsFs), file2)
+	checkNewSymlink(t, fs, file2)
 
 	// test restore by removing symlinks and running Restore
-	err = os.Remove(dir)
+	err = fs.Remove(dir)
 	Ok(t, err)
-	err = os.Remove(dirhome)
+	err = fs.Remove(dirhome)
 	Ok(t, err)
-	err = os.Remove(filehome)
+	err = fs.Remove(filehome)
 	Ok(t, err)
-	err = os.Remove(file1)
+	err = fs.Remove(file1)
 	Ok(t, err)
-	err = os.Remove(file2)
+	err = fs.Remove(file2)
 	Ok(t, err)
 
 	err = b.Restore()
+	checkFailedPaths(t, err, symlink)
+
+	checkNewSymlink(t, fs, dir)
+	checkNewSymlink(t, fs, dirhome)
+	checkNewSymlink(t, fs, filehome)
+	checkNewSymlink(t, fs, file1)
+	checkNewSymlink(t, fs, file2)
+	checkNewSymlink(t, fs, confPath)
+
+	err = b.Uninstall()
+	checkFailedPaths(t, err, symlink)
+
+	checkNotSymlink(t, fs, dir)
+	checkNotSymlink(t, fs, dirhome)
+	checkNotSymlink(t, fs, filehome)
+	checkNotSymlink(t, fs, file1)
+	checkNotSymlink(t, fs, file2)
+	checkNotSymlink(t, fs, confPath)
+}
+
+// newTestBackedup creates a temporary home directory on fs with the config
+// cfg, where %[1]s is replaced with the temporary directory, and returns a
+// Backedup for it. The returned func removes the temporary directory.
+func newTestBackedup(t *testing.T, fs FS, cfg string) (*Backedup, string, func()) {
+	var stdin bytes.Buffer
+	var logger bytes.Buffer
+	tmpDir, err := afero.TempDir(fs, "", "")
+	Ok(t, err)
+	home := filepath.Join(tmpDir, "home")
+	err = fs.MkdirAll(home, 0755)
 	Ok(t, err)
+	os.Setenv("HOME", home)
+	confPath := filepath.Join(home, ".backedup.yaml")
+	err = afero.WriteFile(fs, confPath, []byte(fmt.Sprintf(cfg, tmpDir)), 0644)
+	Ok(t, err)
+	b, err := New(fs, &stdin, &logger, confPath)
+	Ok(t, err)
+	return b, tmpDir, func() { fs.RemoveAll(tmpDir) }
+}
 
-	checkNewSymlink(t, fs.(*afero.OsFs), dir)
-	checkNewSymlink(t, fs.(*afero.OsFs), dirhome)
-	checkNewSymlink(t, fs.(*afero.OsFs), filehome)
-	checkNewSymlink(t, fs.(*afero.OsFs), file1)
-	checkNewSymlink(t, fs.(*afero.OsFs), file2)
-	checkNewSymlink(t, fs.(*afero.OsFs), confPath)
+func TestPathConfigUnmarshal(t *testing.T) {
+	conf := &Config{}
+	err := yaml.Unmarshal([]byte(`
+backup_to: /backup
+conflict: skip
+paths:
+  - /plain
+  - path: /object
+    conflict: overwrite
+`), conf)
+	Ok(t, err)
+	Equals(t, []PathConfig{{Path: "/plain"}, {Path: "/object", Conflict: ConflictOverwrite}}, conf.Paths)
+	Equals(t, ConflictSkip, conf.conflictPolicy(conf.Paths[0]))
+	Equals(t, ConflictOverwrite, conf.conflictPolicy(conf.Paths[1]))
+
+	conf.Conflict = "replace"
+	Equals(t, `unknown conflict policy "replace"`, fmt.Sprint(conf.Validate()))
+
+	conf = &Config{}
+	err = yaml.Unmarshal([]byte(`
+paths:
+  - path: /options
+    mode: link-files
+    optional: true
+    hosts: [laptop]
+    tags: [shell, work]
+    exclude: ["*.log"]
+    perm: 0600
+`), conf)
+	Ok(t, err)
+	Equals(t, []PathConfig{{
+		Path: "/options", Mode: ModeLinkFiles, Optional: true, Hosts: []string{"laptop"},
+		Tags: []string{"shell", "work"}, Exclude: []string{"*.log"}, Perm: "0600",
+	}}, conf.Paths)
+	Ok(t, conf.Validate())
+	conf.Paths[0].Perm = "rw"
+	Equals(t, `/options invalid perm "rw"`, fmt.Sprint(conf.Validate()))
+}
+
+func TestPathOptions(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - path: $HOME/.missing
+    optional: true
+  - path: $HOME/.other-host
+    hosts: [other-host]
+  - path: $HOME/.netrc
+    perm: "0600"
+    tags: [secret]
+  - path: $HOME/.vim
+    mode: link-files`)
+	defer cleanup()
+	home := b.homeDir
+	for _, path := range []string{".other-host", ".netrc", ".vim/vimrc", ".vim/colors/dark.vim"} {
+		err := afero.WriteFile(b.fs, filepath.Join(home, path), []byte(path), 0644)
+		Ok(t, err)
+	}
+
+	b.Tags = []string{"secret"}
+	plan, err := b.PlanBackup()
+	Ok(t, err)
+	Equals(t, 3, len(plan))
+	Equals(t, ActionChmod, plan[2].Type)
+
+	b.Tags = nil
+	err = b.Backup()
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, filepath.Join(home, ".other-host"))
+	checkNewSymlink(t, b.fs, filepath.Join(home, ".netrc"))
+	fi, err := b.fs.Stat(b.backupPath(filepath.Join(home, ".netrc")))
+	Ok(t, err)
+	Equals(t, os.FileMode(0600), fi.Mode().Perm())
+	checkNotSymlink(t, b.fs, filepath.Join(home, ".vim"))
+	checkNewSymlink(t, b.fs, filepath.Join(home, ".vim/vimrc"))
+	checkNewSymlink(t, b.fs, filepath.Join(home, ".vim/colors/dark.vim"))
+
+	// restore skips the optional path and enforces perm again.
+	err = b.fs.Chmod(b.backupPath(filepath.Join(home, ".netrc")), 0644)
+	Ok(t, err)
+	err = b.fs.RemoveAll(filepath.Join(home, ".vim"))
+	Ok(t, err)
+	plan, err = b.PlanRestore()
+	Ok(t, err)
+	Equals(t, Action{Type: ActionSkip, Path: filepath.Join(home, ".missing"), Reason: "optional, not backed up"}, plan[0])
+	err = b.Apply(plan)
+	Ok(t, err)
+	fi, err = b.fs.Stat(b.backupPath(filepath.Join(home, ".netrc")))
+	Ok(t, err)
+	Equals(t, os.FileMode(0600), fi.Mode().Perm())
+	checkNewSymlink(t, b.fs, filepath.Join(home, ".vim/colors/dark.vim"))
 
 	err = b.Uninstall()
 	Ok(t, err)
+	checkNotSymlink(t, b.fs, filepath.Join(home, ".netrc"))
+	checkNotSymlink(t, b.fs, filepath.Join(home, ".vim/colors/dark.vim"))
+}
+
+func TestRestoreConflict(t *testing.T) {
+	tests := []struct {
+		policy   ConflictPolicy
+		answer   string
+		linked   bool
+		origKept bool
+	}{
+		{policy: ConflictError},
+		{policy: ConflictSkip},
+		{policy: ConflictBackup, linked: true, origKept: true},
+		{policy: ConflictOverwrite, linked: true},
+		{policy: ConflictPrompt, answer: "backup\n", linked: true, origKept: true},
+		{policy: ConflictPrompt, answer: "no\n"},
+	}
+	for _, tt := range tests {
+		b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - path: $HOME/.bashrc
+    conflict: `+string(tt.policy))
+		path := b.Config.Paths[0].Path
+		backupPath := b.backupPath(path)
+		err := b.fs.MkdirAll(filepath.Dir(backupPath), 0755)
+		Ok(t, err)
+		err = afero.WriteFile(b.fs, backupPath, []byte("backed up"), 0644)
+		Ok(t, err)
+		err = afero.WriteFile(b.fs, path, []byte("stock"), 0644)
+		Ok(t, err)
+		b.stdin.Reset(bytes.NewBufferString(tt.answer))
 
-	checkNotSymlink(t, fs.(*afero.OsFs), dir)
-	checkNotSymlink(t, fs.(*afero.OsFs), dirhome)
-	checkNotSymlink(t, fs.(*afero.OsFs), filehome)
-	checkNotSymlink(t, fs.(*afero.OsFs), file1)
-	checkNotSymlink(t, fs.(*afero.OsFs), file2)
-	checkNotSymlink(t, fs.(*afero.OsFs), confPath)
+		err = b.Restore()
+		if tt.policy == ConflictError {
+			Equals(t, true, errors.Is(err, ErrFileExists))
+		} else {
+			Ok(t, err)
+		}
+		target, _ := b.fs.Readlink(path)
+		Equals(t, tt.linked, target == backupPath, string(tt.policy))
+		origs, err := afero.Glob(b.fs, path+".*"+origSuffix)
+		Ok(t, err)
+		Equals(t, tt.origKept, len(origs) == 1, string(tt.policy))
+		cleanup()
+	}
+}
+
+func TestRestoreConflictPlan(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+conflict: overwrite
+paths:
+  - path: $HOME/.bashrc
+    conflict: prompt
+  - path: $HOME/.zshrc
+    conflict: error`)
+	defer cleanup()
+	bashrc, zshrc := b.Config.Paths[0].Path, b.Config.Paths[1].Path
+	for _, path := range []string{bashrc, zshrc} {
+		err := afero.WriteFile(b.fs, b.backupPath(path), []byte("backed up"), 0644)
+		Ok(t, err)
+		err = afero.WriteFile(b.fs, path, []byte("stock"), 0644)
+		Ok(t, err)
+	}
+	b.stdin.Reset(bytes.NewBufferString("overwrite\n"))
+
+	// planning doesn't ask, and error isn't replaced by the global policy.
+	plan, err := b.PlanRestore()
+	Ok(t, err)
+	Equals(t, Plan{
+		{Type: ActionPrompt, Path: bashrc, Dst: bashrc},
+		{Type: ActionSymlink, Path: bashrc, Src: b.backupPath(bashrc), Dst: bashrc},
+		{Type: ActionSkip, Path: zshrc, Reason: ErrFileExists.Error(), Err: ErrFileExists},
+	}, plan)
+	Equals(t, "prompt   "+bashrc, plan[0].String())
+
+	// the answer is read when the plan runs.
+	err = b.Restore()
+	checkFailedPaths(t, err, zshrc)
+	checkNewSymlink(t, b.fs, bashrc)
+	Equals(t, "stock", readString(t, b.fs, zshrc))
 }
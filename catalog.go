@@ -0,0 +1,124 @@
+package backedup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultCatalogDir is the directory with the user's app definitions.
+var DefaultCatalogDir = "$HOME/.config/backedup/apps"
+
+// App is a named group of paths that belong to an application.
+type App struct {
+	// Name is used in Config.Apps, it defaults to the file name without the
+	// extension for definitions in the catalog directory.
+	Name string `json:"name" yaml:"name"`
+	// Paths are the files and directories of the app, with the same options
+	// as Config.Paths.
+	Paths []PathConfig `json:"paths" yaml:"paths"`
+}
+
+// builtinApps are the app definitions available without a catalog
+// directory. Not every file of an app exists on every machine, so all of
+// them are optional.
+var builtinApps = []App{
+	optionalApp("aws", "$HOME/.aws"),
+	optionalApp("bash", "$HOME/.bashrc", "$HOME/.bash_profile", "$HOME/.bash_history"),
+	optionalApp("docker", "$HOME/.docker", "$HOME/.dockercfg"),
+	optionalApp("git", "$HOME/.gitconfig", "$HOME/.gitignore", "$HOME/.gitignore_global", "$HOME/.config/git"),
+	optionalApp("ssh", "$HOME/.ssh"),
+	optionalApp("terraform", "$HOME/.terraformrc", "$HOME/.terraform.d"),
+	optionalApp("tmux", "$HOME/.tmux.conf", "$HOME/.config/tmux"),
+	optionalApp("vim", "$HOME/.vimrc", "$HOME/.gvimrc", "$HOME/.vim"),
+	optionalApp("zsh", "$HOME/.zshrc", "$HOME/.zshenv", "$HOME/.zprofile", "$HOME/.zlogin", "$HOME/.zlogout"),
+}
+
+// optionalApp returns an app with optional paths.
+func optionalApp(name string, paths ...string) App {
+	app := App{Name: name}
+	for _, path := range paths {
+		app.Paths = append(app.Paths, PathConfig{Path: path, Optional: true})
+	}
+	return app
+}
+
+// Catalog returns the built-in app definitions together with the ones in
+// the catalog directory, sorted by name. A definition in the directory
+// replaces a built-in one with the same name.
+func (b *Backedup) Catalog() ([]App, error) {
+	apps := map[string]App{}
+	for _, app := range builtinApps {
+		apps[app.Name] = app
+	}
+	dir := os.ExpandEnv(b.Config.catalogDir())
+	fis, err := afero.ReadDir(b.fs, dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range fis {
+		ext := filepath.Ext(fi.Name())
+		if fi.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		data, err := afero.ReadFile(b.fs, path)
+		if err != nil {
+			return nil, err
+		}
+		app := App{}
+		if err := yaml.Unmarshal(data, &app); err != nil {
+			return nil, fmt.Errorf("%s %s", path, err)
+		}
+		if app.Name == "" {
+			app.Name = strings.TrimSuffix(fi.Name(), ext)
+		}
+		apps[app.Name] = app
+	}
+	catalog := make([]App, 0, len(apps))
+	for _, app := range apps {
+		catalog = append(catalog, app)
+	}
+	sort.Slice(catalog, func(i, j int) bool { return catalog[i].Name < catalog[j].Name })
+	return catalog, nil
+}
+
+// loadApps looks up Config.Apps in the catalog and returns their paths with
+// $HOME expanded. Every path is tagged with the name of its app.
+func (b *Backedup) loadApps() ([]PathConfig, error) {
+	if len(b.Config.Apps) == 0 {
+		return nil, nil
+	}
+	catalog, err := b.Catalog()
+	if err != nil {
+		return nil, err
+	}
+	apps := map[string]App{}
+	for _, app := range catalog {
+		apps[app.Name] = app
+	}
+	paths := []PathConfig{}
+	for _, name := range b.Config.Apps {
+		app, ok := apps[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown app %q", name)
+		}
+		for _, p := range app.Paths {
+			if err := p.validate(); err != nil {
+				return nil, fmt.Errorf("app %s %s", name, err)
+			}
+			if err := b.Config.validateStorage(p); err != nil {
+				return nil, fmt.Errorf("app %s %s", name, err)
+			}
+			p = p.expandEnv()
+			p.Tags = append(append([]string{}, p.Tags...), name)
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,66 @@
+package backedup
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestCatalog(t *testing.T) {
+	b, tmpDir, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+catalog: %[1]s/apps
+apps: [git]
+paths:
+  - $HOME/.gitconfig`)
+	defer cleanup()
+	err := afero.WriteFile(b.fs, filepath.Join(tmpDir, "apps/myapp.yaml"), []byte(`
+paths:
+  - $HOME/.myapprc
+  - path: $HOME/.config/myapp
+    mode: copy
+`), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(tmpDir, "apps/git.yml"), []byte(`
+name: git
+paths:
+  - $HOME/.gitconfig
+`), 0644)
+	Ok(t, err)
+
+	catalog, err := b.Catalog()
+	Ok(t, err)
+	names := []string{}
+	for _, app := range catalog {
+		names = append(names, app.Name)
+	}
+	Equals(t, []string{"aws", "bash", "docker", "git", "myapp", "ssh", "terraform", "tmux", "vim", "zsh"}, names)
+
+	b.Config.Apps = []string{"git", "myapp"}
+	paths, err := b.loadApps()
+	Ok(t, err)
+	b.appPaths = paths
+	home := b.homeDir
+	Equals(t, []PathConfig{
+		{Path: filepath.Join(home, ".gitconfig"), Tags: []string{"git"}},
+		{Path: filepath.Join(home, ".myapprc"), Tags: []string{"myapp"}},
+		{Path: filepath.Join(home, ".config/myapp"), Mode: ModeCopy, Tags: []string{"myapp"}},
+	}, paths)
+
+	// a path in both paths and an app is used once, apps can be selected
+	// by their name.
+	b.Tags = []string{"myapp"}
+	resolved, err := b.resolvePaths(true, false)
+	Ok(t, err)
+	Equals(t, 2, len(resolved))
+	b.Tags = nil
+	resolved, err = b.resolvePaths(true, false)
+	Ok(t, err)
+	Equals(t, 3, len(resolved))
+
+	b.Config.Apps = []string{"nope"}
+	_, err = b.loadApps()
+	Equals(t, `unknown app "nope"`, fmt.Sprint(err))
+}
@@ -1,45 +1,355 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 
 	"github.com/pkar/backedup"
-	"github.com/spf13/afero"
 )
 
+// exit codes, scripts can tell a partial failure from a total one.
+const (
+	exitOK = iota
+	// exitFailure when the command or every path failed.
+	exitFailure
+	// exitConfig for usage errors or a config that can't be loaded.
+	exitConfig
+	// exitPartial when some of the paths failed.
+	exitPartial
+)
+
+// fatal prints err and exits with code.
+func fatal(code int, err error) {
+	fmt.Println("ERRO:", err)
+	os.Exit(code)
+}
+
+// exitCode maps an error of a command to the exit code.
+func exitCode(err error) int {
+	var errs *backedup.MultiError
+	if errors.As(err, &errs) && errs.Partial() {
+		return exitPartial
+	}
+	return exitFailure
+}
+
 func main() {
 	backedupCfgPath := flag.String("config", backedup.DefaultCfgPath, "The the path to the backedup config file")
 	backup := flag.Bool("backup", false, "create symlinks for files configured to the backup path.")
 	restore := flag.Bool("restore", false, "create symlinks for previously backed up files.")
 	uninstall := flag.Bool("uninstall", false, "restore the configured files found in the config file to the originals without symlinks.")
+	sync := flag.Bool("sync", false, "push local changes of copy mode paths to the backup path and pull changes from it.")
+	dryRun := flag.Bool("dry-run", false, "print the planned actions of -backup, -restore, -uninstall or -sync without changing anything.")
+	status := flag.Bool("status", false, "report the link state of every configured path.")
+	jsonOut := flag.Bool("json", false, "print -status, -scan, -snapshots or -log as JSON instead of a table.")
+	conflict := flag.String("conflict", "", "what -restore does with existing files at a path, one of error, skip, backup, overwrite or prompt. Overrides the config default but not per path settings.")
+	tags := flag.String("tags", "", "comma separated tags, only the paths with one of them are used.")
+	profile := flag.String("profile", "", "the profile to use instead of the one selected by $BACKEDUP_PROFILE or the hostname.")
+	snapshot := flag.Bool("snapshot", false, "store a snapshot of the backup path and remove the ones the retention rules don't keep.")
+	snapshots := flag.Bool("snapshots", false, "list the snapshots of the backup path.")
+	restoreSnapshot := flag.String("restore-snapshot", "", "replace the content of the backup path with the snapshot with this id.")
+	export := flag.String("export", "", "write the config and the backup path to a .tar.gz or .zip archive, - for stdout.")
+	importPath := flag.String("import", "", "unpack a .tar.gz or .zip archive of -export into the empty backup path, - for stdin. Restores it with -restore.")
+	watch := flag.Bool("watch", false, "watch the backup path and the configured paths, absorb replaced symlinks and run watch.on_change after every burst of changes until SIGINT or SIGTERM.")
+	commit := flag.Bool("commit", false, "commit the changes of the backup path with backend git.")
+	logPath := flag.String("log", "", "show the commits that changed the backup of a path with backend git.")
+	gc := flag.Bool("gc", false, "remove the blobs of the snapshot object store no snapshot uses.")
+	check := flag.Bool("check", false, "verify the blobs of the snapshot object store, exits with 1 if any is missing or corrupt.")
+	verify := flag.Bool("verify", false, "read the backup path again and compare it with the manifest.json of the last run that changed it, exits with 1 if any file is missing, modified, extra or unreadable. Edits to linked files since that run count as changes and are listed as edited, they don't fail it.")
+	scan := flag.Bool("scan", false, "report possible secrets in the configured paths, exits with 1 if any of them would block -backup.")
+	apps := flag.Bool("apps", false, "list the app definitions that can be used in apps.")
+	recoverMode := flag.String("recover", "", "finish or rollback a run that was interrupted before running the requested command.")
+	keygen := flag.String("keygen", "", "write a new key file for encrypted paths to the given path and exit.")
 	flag.Parse()
 
-	b, err := backedup.New(afero.NewOsFs(), os.Stdin, os.Stderr, *backedupCfgPath)
+	if *keygen != "" {
+		if err := backedup.GenerateKeyFile(backedup.NewOsFs(), *keygen); err != nil {
+			fatal(exitFailure, err)
+		}
+		fmt.Println("done")
+		return
+	}
+
+	if *importPath != "" {
+		format, err := backedup.ArchiveFormatOf(*importPath)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		in := os.Stdin
+		if *importPath != "-" {
+			if in, err = os.Open(*importPath); err != nil {
+				fatal(exitFailure, err)
+			}
+			defer in.Close()
+		}
+		backupTo, err := backedup.Import(backedup.NewOsFs(), in, format, os.Stderr, *backedupCfgPath)
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		fmt.Fprintln(os.Stderr, "imported to", backupTo)
+		if !*restore {
+			return
+		}
+	}
+
+	b, err := backedup.New(backedup.NewOsFs(), os.Stdin, os.Stderr, *backedupCfgPath)
 	if err != nil {
-		fmt.Println("ERRO:", err)
-		os.Exit(1)
+		fatal(exitConfig, err)
+	}
+	if *profile != "" {
+		if err := b.SetProfile(*profile); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+	if *tags != "" {
+		b.Tags = strings.Split(*tags, ",")
+	}
+	// only a run that changes encrypted paths asks for their passphrase.
+	b.NoPrompt = *dryRun || *status
+	if *conflict != "" {
+		b.Config.Conflict = backedup.ConflictPolicy(*conflict)
+		if err := b.Config.Validate(); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+	if *recoverMode != "" {
+		if err := b.Recover(backedup.RecoverMode(*recoverMode)); err != nil {
+			fatal(exitCode(err), err)
+		}
+		if !*backup && !*restore && !*uninstall && !*sync && *restoreSnapshot == "" {
+			fmt.Println("done")
+			return
+		}
+	}
+	if *apps {
+		catalog, err := b.Catalog()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		for _, app := range catalog {
+			paths := make([]string, len(app.Paths))
+			for i, p := range app.Paths {
+				paths[i] = p.Path
+			}
+			fmt.Printf("%s\t%s\n", app.Name, strings.Join(paths, " "))
+		}
+		return
+	}
+	if *snapshot {
+		s, err := b.Snapshot()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		fmt.Println(s.ID)
+		return
+	}
+	if *snapshots {
+		list, err := b.Snapshots()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(list)
+			return
+		}
+		for _, s := range list {
+			fmt.Printf("%s\t%s\t%s\n", s.ID, s.Time.Local().Format("2006-01-02 15:04:05"), s.Store)
+		}
+		return
+	}
+	if *export != "" {
+		format, err := backedup.ArchiveFormatOf(*export)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		if *export == "-" {
+			if err := b.Export(os.Stdout, format); err != nil {
+				fatal(exitFailure, err)
+			}
+			return
+		}
+		out, err := os.Create(*export)
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		err = b.Export(out, format)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(*export)
+			fatal(exitFailure, err)
+		}
+		fmt.Fprintln(os.Stderr, "exported to", *export)
+		return
+	}
+	if *watch {
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			cancel()
+		}()
+		if err := b.Watch(ctx); err != nil {
+			fatal(exitFailure, err)
+		}
+		fmt.Println("done")
+		return
+	}
+	if *commit {
+		committed, err := b.Commit()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		if !committed {
+			fmt.Println("nothing to commit")
+			return
+		}
+		fmt.Println("done")
+		return
 	}
+	if *logPath != "" {
+		commits, err := b.Log(*logPath)
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(commits)
+			return
+		}
+		for _, c := range commits {
+			fmt.Printf("%s %s %s\n", c.Hash[:8], c.Time.Local().Format("2006-01-02 15:04"), c.Subject)
+		}
+		return
+	}
+	if *gc {
+		n, size, err := b.GC()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		fmt.Printf("removed %d blobs, %d bytes\n", n, size)
+		return
+	}
+	if *check {
+		problems, err := b.Check()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			os.Exit(exitFailure)
+		}
+		fmt.Println("ok")
+		return
+	}
+	if *verify {
+		problems, err := b.Verify()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		damaged := false
+		for _, p := range problems {
+			fmt.Println(p)
+			damaged = damaged || p.State != backedup.VerifyEdited
+		}
+		if damaged {
+			os.Exit(exitFailure)
+		}
+		fmt.Println("ok")
+		return
+	}
+	if *scan {
+		findings, err := b.Scan()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		blocked := false
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(findings)
+		}
+		for _, f := range findings {
+			blocked = blocked || !f.Allowed
+			if *jsonOut {
+				continue
+			}
+			if f.Allowed {
+				fmt.Println(f, "(allowed)")
+			} else {
+				fmt.Println(f)
+			}
+		}
+		if blocked {
+			os.Exit(exitFailure)
+		}
+		return
+	}
+	if *status {
+		statuses, err := b.Status()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(statuses)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "STATE\tPATH\tTARGET")
+		for _, s := range statuses {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.State, s.Path, s.Target)
+		}
+		w.Flush()
+		return
+	}
+	var planFn func() (backedup.Plan, error)
+	var runFn func() error
 	switch {
 	case *uninstall:
-		if err := b.Uninstall(); err != nil {
-			fmt.Println("ERRO:", err)
-			os.Exit(1)
-		}
+		planFn, runFn = b.PlanUninstall, b.Uninstall
 	case *backup:
-		if err := b.Backup(); err != nil {
-			fmt.Println("ERRO:", err)
-			os.Exit(1)
-		}
+		planFn, runFn = b.PlanBackup, b.Backup
 	case *restore:
-		if err := b.Restore(); err != nil {
-			fmt.Println("ERRO:", err)
-			os.Exit(1)
-		}
+		planFn, runFn = b.PlanRestore, b.Restore
+	case *sync:
+		planFn, runFn = b.PlanSync, b.Sync
+	case *restoreSnapshot != "":
+		planFn = func() (backedup.Plan, error) { return b.PlanRestoreSnapshot(*restoreSnapshot) }
+		runFn = func() error { return b.RestoreSnapshot(*restoreSnapshot) }
 	default:
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitConfig)
+	}
+	if *dryRun {
+		plan, err := planFn()
+		if err != nil {
+			fatal(exitFailure, err)
+		}
+		fmt.Print(plan)
+		return
+	}
+	if err := runFn(); err != nil {
+		if err == backedup.ErrJournalExists {
+			fmt.Println("run again with -recover finish or -recover rollback")
+		}
+		fatal(exitCode(err), err)
 	}
 	fmt.Println("done")
 }
@@ -1,6 +1,11 @@
 package backedup
 
-import "path/filepath"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
 
 var (
 	// DefaultBackupTo is the path to the directory for backing up files.
@@ -47,10 +52,278 @@ paths:
 `
 )
 
+// ConflictPolicy decides what Restore does when a file already exists where
+// a symlink should be created.
+type ConflictPolicy string
+
+const (
+	// ConflictError leaves the existing file and reports an error, this is
+	// the default.
+	ConflictError ConflictPolicy = "error"
+	// ConflictSkip leaves the existing file without reporting an error.
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictBackup moves the existing file aside to a timestamped
+	// .backedup-orig file.
+	ConflictBackup ConflictPolicy = "backup"
+	// ConflictOverwrite removes the existing file.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictPrompt asks on stdin which of the other policies to use.
+	ConflictPrompt ConflictPolicy = "prompt"
+)
+
+// PathMode is how a path is kept in the backup directory.
+type PathMode string
+
+const (
+	// ModeLink moves the path to the backup directory and symlinks it, this
+	// is the default.
+	ModeLink PathMode = "link"
+	// ModeCopy copies the path to the backup directory and leaves the
+	// original in place, Sync keeps both copies up to date.
+	ModeCopy PathMode = "copy"
+	// ModeLinkFiles moves the path to the backup directory like ModeLink,
+	// but symlinks every file of a directory instead of the directory.
+	ModeLinkFiles PathMode = "link-files"
+)
+
+// SnapshotStore is how snapshots are kept in the backup directory.
+type SnapshotStore string
+
+const (
+	// StoreLinks copies the backup directory for every snapshot and hard
+	// links files that didn't change, this is the default.
+	StoreLinks SnapshotStore = "links"
+	// StoreObjects keeps file contents once as blobs named by their hash
+	// and a tree of every snapshot listing its files.
+	StoreObjects SnapshotStore = "objects"
+)
+
 // Config holds the main config file for backedup
 type Config struct {
-	// BackupTo is the folder to move files to that are then symlinked.
+	// BackupTo is the folder to move files to that are then symlinked. A
+	// URL like s3://bucket/prefix keeps the files in that storage, for copy
+	// mode paths only.
 	BackupTo string `json:"backup_to" yaml:"backup_to"`
+	// Conflict is the default policy for existing files on Restore.
+	Conflict ConflictPolicy `json:"conflict,omitempty" yaml:"conflict,omitempty"`
+	// Mode is the default PathMode.
+	Mode PathMode `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// Exclude are gitignore style patterns of entries inside backed up
+	// directories that stay local.
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
 	// Paths are the file or directory paths to symlink
-	Paths []string `json:"paths" yaml:"paths"`
+	Paths []PathConfig `json:"paths" yaml:"paths"`
+	// Apps are names of app definitions whose paths are used next to Paths.
+	Apps []string `json:"apps,omitempty" yaml:"apps,omitempty"`
+	// Catalog is the directory with app definitions, DefaultCatalogDir if
+	// empty.
+	Catalog string `json:"catalog,omitempty" yaml:"catalog,omitempty"`
+	// Profiles are named changes to the paths for some machines.
+	Profiles map[string]Profile `json:"profiles,omitempty" yaml:"profiles,omitempty"`
+	// KeyFile is the key file for encrypted paths, created with -keygen.
+	// Without one a passphrase is used.
+	KeyFile string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	// Snapshots are the retention rules applied after a snapshot is taken.
+	Snapshots Retention `json:"snapshots,omitempty" yaml:"snapshots,omitempty"`
+	// SnapshotStore is how new snapshots are kept, StoreLinks if empty.
+	SnapshotStore SnapshotStore `json:"snapshot_store,omitempty" yaml:"snapshot_store,omitempty"`
+	// Backend keeps the history of the backup directory.
+	Backend Backend `json:"backend,omitempty" yaml:"backend,omitempty"`
+	// Git are the options of BackendGit.
+	Git GitConfig `json:"git,omitempty" yaml:"git,omitempty"`
+	// Watch are the options of Watch.
+	Watch WatchConfig `json:"watch,omitempty" yaml:"watch,omitempty"`
+	// Storage keeps copy mode paths, archives and the sync state, the
+	// backup directory if empty.
+	Storage StorageConfig `json:"storage,omitempty" yaml:"storage,omitempty"`
+	// Vars are passed to templates, the profile can override them.
+	Vars map[string]string `json:"vars,omitempty" yaml:"vars,omitempty"`
+	// remote is the backup_to URL replaced by remoteBackupTo.
+	remote string
+}
+
+// catalogDir returns the directory with app definitions.
+func (c *Config) catalogDir() string {
+	if c.Catalog != "" {
+		return c.Catalog
+	}
+	return DefaultCatalogDir
+}
+
+// PathConfig is a single entry of Config.Paths. In yaml it is either a plain
+// path string or a mapping with the path and its options.
+type PathConfig struct {
+	// Path is the file or directory path to symlink.
+	Path string `json:"path" yaml:"path"`
+	// Conflict overrides Config.Conflict for this path.
+	Conflict ConflictPolicy `json:"conflict,omitempty" yaml:"conflict,omitempty"`
+	// Mode overrides Config.Mode for this path.
+	Mode PathMode `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// Exclude are added to Config.Exclude for this path.
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	// Optional paths are skipped instead of failing when they don't exist.
+	Optional bool `json:"optional,omitempty" yaml:"optional,omitempty"`
+	// Hosts limits the path to these hostnames, all hosts if empty.
+	Hosts []string `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	// Tags select the path with Backedup.Tags.
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// Perm is an octal file mode like 0600 enforced on the path.
+	Perm string `json:"perm,omitempty" yaml:"perm,omitempty"`
+	// Template paths are kept as text/template sources in the backup
+	// directory and rendered on Restore instead of linked.
+	Template bool `json:"template,omitempty" yaml:"template,omitempty"`
+	// Encrypt paths are kept encrypted in the backup directory and
+	// decrypted on Restore instead of linked.
+	Encrypt bool `json:"encrypt,omitempty" yaml:"encrypt,omitempty"`
+	// AllowSecrets backs up the path even if it looks like it contains
+	// secrets.
+	AllowSecrets bool `json:"allow_secrets,omitempty" yaml:"allow_secrets,omitempty"`
+}
+
+// perm returns the parsed Perm and whether it is set.
+func (p PathConfig) perm() (os.FileMode, bool, error) {
+	if p.Perm == "" {
+		return 0, false, nil
+	}
+	perm, err := strconv.ParseUint(p.Perm, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, false, fmt.Errorf("invalid perm %q", p.Perm)
+	}
+	return os.FileMode(perm), true, nil
+}
+
+// UnmarshalYAML accepts either a plain path string or a mapping.
+func (p *PathConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		*p = PathConfig{Path: path}
+		return nil
+	}
+	// the alias type avoids recursing into UnmarshalYAML.
+	type pathConfig PathConfig
+	var pc pathConfig
+	if err := unmarshal(&pc); err != nil {
+		return err
+	}
+	*p = PathConfig(pc)
+	return nil
+}
+
+// Validate checks the config for unknown option values.
+func (c *Config) Validate() error {
+	if err := c.Conflict.validate(); err != nil {
+		return err
+	}
+	if err := c.Mode.validate(); err != nil {
+		return err
+	}
+	if err := c.SnapshotStore.validate(); err != nil {
+		return err
+	}
+	if err := c.Backend.validate(); err != nil {
+		return err
+	}
+	if err := c.Watch.validate(); err != nil {
+		return err
+	}
+	if scheme, ok := backupToScheme(c.BackupTo); ok && c.Storage.Type != "" && c.Storage.Type != scheme {
+		return fmt.Errorf("storage type %s doesn't match backup_to %s", c.Storage.Type, c.BackupTo)
+	}
+	for _, p := range c.Paths {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if err := c.validateStorage(p); err != nil {
+			return err
+		}
+	}
+	for name, profile := range c.Profiles {
+		for _, p := range profile.Include {
+			if err := p.validate(); err != nil {
+				return fmt.Errorf("profile %s %s", name, err)
+			}
+			if err := c.validateStorage(p); err != nil {
+				return fmt.Errorf("profile %s %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the options of a path.
+func (p PathConfig) validate() error {
+	if err := p.Conflict.validate(); err != nil {
+		return fmt.Errorf("%s %s", p.Path, err)
+	}
+	if err := p.Mode.validate(); err != nil {
+		return fmt.Errorf("%s %s", p.Path, err)
+	}
+	if _, _, err := p.perm(); err != nil {
+		return fmt.Errorf("%s %s", p.Path, err)
+	}
+	if p.Template && p.Encrypt {
+		return fmt.Errorf("%s can't be a template and encrypted", p.Path)
+	}
+	return nil
+}
+
+// expandEnv returns p with environment variables in its path and excludes
+// expanded.
+func (p PathConfig) expandEnv() PathConfig {
+	p.Path = os.ExpandEnv(p.Path)
+	if p.Exclude != nil {
+		excludes := make([]string, len(p.Exclude))
+		for i, exclude := range p.Exclude {
+			excludes[i] = os.ExpandEnv(exclude)
+		}
+		p.Exclude = excludes
+	}
+	return p
+}
+
+// validate returns an error for unknown modes.
+func (m PathMode) validate() error {
+	switch m {
+	case "", ModeLink, ModeCopy, ModeLinkFiles:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", m)
+}
+
+// validate returns an error for unknown stores.
+func (s SnapshotStore) validate() error {
+	switch s {
+	case "", StoreLinks, StoreObjects:
+		return nil
+	}
+	return fmt.Errorf("unknown snapshot store %q", s)
+}
+
+// validate returns an error for unknown policies.
+func (c ConflictPolicy) validate() error {
+	switch c {
+	case "", ConflictError, ConflictSkip, ConflictBackup, ConflictOverwrite, ConflictPrompt:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q", c)
+}
+
+// conflictPolicy returns the policy for a path, falling back to the global
+// one.
+func (c *Config) conflictPolicy(p PathConfig) ConflictPolicy {
+	if p.Conflict != "" {
+		return p.Conflict
+	}
+	return c.Conflict
+}
+
+// mode returns the mode of a path, falling back to the global one.
+func (c *Config) mode(p PathConfig) PathMode {
+	if p.Mode != "" {
+		return p.Mode
+	}
+	if c.Mode != "" {
+		return c.Mode
+	}
+	return ModeLink
 }
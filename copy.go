@@ -0,0 +1,360 @@
+package backedup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// CopyError lists the entries a copy failed for, the others were copied.
+// errors.Is and errors.As match against every failure.
+type CopyError struct {
+	// Src is the file or directory that was copied.
+	Src string
+	// Errors are the failed entries in the order they were copied.
+	Errors []*CopyEntryError
+}
+
+// CopyEntryError is the failure of a single entry of a copy.
+type CopyEntryError struct {
+	// Path is the entry in the source.
+	Path string
+	// Err is the cause.
+	Err error
+}
+
+// Error implements error.
+func (e *CopyEntryError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+// Unwrap returns the cause.
+func (e *CopyEntryError) Unwrap() error {
+	return e.Err
+}
+
+// Error implements error.
+func (e *CopyError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("copy %s failed for %d entries: %s", e.Src, len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Is reports whether any of the failures matches target.
+func (e *CopyError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first failure that matches target.
+func (e *CopyError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// errNoXattrs is the cause of setting an xattr on a filesystem without
+// them.
+var errNoXattrs = errors.New("xattrs not supported")
+
+// FileCopy copies the file src to dst on disk, see FileCopyFS.
+func FileCopy(src, dst string) error {
+	return FileCopyFS(NewOsFs(), src, dst)
+}
+
+// FileCopyFS copies the file src to dst with its metadata like DirCopyFS, a
+// symlink is copied as a symlink. Directories are refused, they are copied
+// with DirCopyFS.
+func FileCopyFS(fs FS, src, dst string) error {
+	fi, err := fs.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return &os.PathError{Op: "copy", Path: src, Err: syscall.EISDIR}
+	}
+	return newCopier(fs, src, nil).run(src, dst)
+}
+
+// DirCopy copies the directory src to dst on disk, see DirCopyFS.
+func DirCopy(src string, dst string) error {
+	return DirCopyFS(NewOsFs(), src, dst)
+}
+
+// DirCopyFS copies a whole directory recursively, leaving out the entries
+// excluded by .backedupignore files in it. Symlinks stay symlinks, hard
+// links within src stay hard links, and modes, times, owners where
+// permitted, user xattrs and holes of sparse files are kept. Sockets, FIFOs
+// and devices are left out. Entries that fail don't stop the copy, they are
+// listed in the returned *CopyError.
+func DirCopyFS(fs FS, src string, dst string) error {
+	return newCopier(fs, src, nil).run(src, dst)
+}
+
+// copyPath copies src to dst like DirCopy and logs the entries it leaves
+// out.
+func (b *Backedup) copyPath(src, dst string) error {
+	return newCopier(b.fs, src, func(path, reason string) {
+		fmt.Fprintf(b.logger, "WARN: %s skipped, %s\n", path, reason)
+	}).run(src, dst)
+}
+
+// fileStat is what a copy keeps of an entry besides its mode and mtime, as
+// far as the platform has it.
+type fileStat struct {
+	uid, gid int
+	// dev and ino identify the file for finding hard links.
+	dev, ino uint64
+	nlink    uint64
+	atime    time.Time
+}
+
+// fileID identifies a file across its hard links.
+type fileID struct {
+	dev, ino uint64
+}
+
+// xattrFS is implemented by the FS that keep extended attributes.
+type xattrFS interface {
+	// listXattrs returns the names of the attributes of name.
+	listXattrs(name string) ([]string, error)
+	getXattr(name, attr string) ([]byte, error)
+	setXattr(name, attr string, data []byte) error
+}
+
+// copier copies a file or a directory tree with its metadata.
+type copier struct {
+	fs FS
+	// skip is told about the entries that are left out, if set.
+	skip func(path, reason string)
+	// links maps files with more than one link to their first copy.
+	links map[fileID]string
+	err   *CopyError
+}
+
+func newCopier(fs FS, src string, skip func(path, reason string)) *copier {
+	return &copier{fs: fs, skip: skip, links: map[fileID]string{}, err: &CopyError{Src: src}}
+}
+
+// run copies src to dst and returns the failures.
+func (c *copier) run(src, dst string) error {
+	c.copy(src, dst, "", &ignoreMatcher{})
+	if len(c.err.Errors) > 0 {
+		return c.err
+	}
+	return nil
+}
+
+// fail records the failure of the entry path.
+func (c *copier) fail(path string, err error) {
+	c.err.Errors = append(c.err.Errors, &CopyEntryError{Path: path, Err: err})
+}
+
+// copy copies the entry src to dst, rel is src relative to the root of m.
+func (c *copier) copy(src, dst, rel string, m *ignoreMatcher) {
+	fi, err := c.fs.Lstat(src)
+	if err != nil {
+		c.fail(src, err)
+		return
+	}
+	mode := fi.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		err = c.copySymlink(src, dst)
+	case fi.IsDir():
+		err = c.copyDir(src, dst, rel, m, fi)
+	case mode.IsRegular():
+		var linked bool
+		if linked, err = c.copyFile(src, dst, fi); linked {
+			if err != nil {
+				c.fail(src, err)
+			}
+			return
+		}
+	default:
+		if c.skip != nil {
+			c.skip(src, specialReason(mode))
+		}
+		return
+	}
+	if err == nil {
+		err = c.copyMeta(src, dst, fi)
+	}
+	if err != nil {
+		c.fail(src, err)
+		return
+	}
+	// later links to the file are linked to this copy, which is complete.
+	if st, ok := statOf(fi); ok && mode.IsRegular() && st.nlink > 1 {
+		c.links[fileID{dev: st.dev, ino: st.ino}] = dst
+	}
+}
+
+// specialReason says why an entry that isn't a file, directory or symlink
+// is left out.
+func specialReason(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	}
+	return "not a regular file"
+}
+
+// removeFile removes dst unless it is missing or a directory, so it can be
+// replaced by a symlink or a hard link.
+func (c *copier) removeFile(dst string) error {
+	if fi, err := c.fs.Lstat(dst); err == nil && !fi.IsDir() {
+		return c.fs.Remove(dst)
+	}
+	return nil
+}
+
+func (c *copier) copySymlink(src, dst string) error {
+	target, err := c.fs.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if err := c.removeFile(dst); err != nil {
+		return err
+	}
+	return c.fs.Symlink(target, dst)
+}
+
+// copyDir creates dst and copies the entries of src into it. Its own
+// metadata is set after the entries so their copies don't change it.
+func (c *copier) copyDir(src, dst, rel string, m *ignoreMatcher, fi os.FileInfo) error {
+	if err := c.fs.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+	m = m.withFile(c.fs, src, rel)
+	fis, err := afero.ReadDir(c.fs, src)
+	if err != nil {
+		return err
+	}
+	for _, fd := range fis {
+		// the matcher works on slash separated paths.
+		relfp := path.Join(rel, fd.Name())
+		if m.match(relfp, fd.IsDir()) {
+			continue
+		}
+		c.copy(filepath.Join(src, fd.Name()), filepath.Join(dst, fd.Name()), relfp, m)
+	}
+	return nil
+}
+
+// copyFile copies the content of src to dst. If src is a hard link to a
+// file copied before dst is linked to that copy, which already has the
+// metadata, and it returns true.
+func (c *copier) copyFile(src, dst string, fi os.FileInfo) (bool, error) {
+	if st, ok := statOf(fi); ok && st.nlink > 1 {
+		if first, ok := c.links[fileID{dev: st.dev, ino: st.ino}]; ok {
+			if err := c.removeFile(dst); err != nil {
+				return true, err
+			}
+			return true, c.fs.Link(first, dst)
+		}
+	}
+	// a symlink at dst is replaced, not written through.
+	if dfi, err := c.fs.Lstat(dst); err == nil && dfi.Mode()&os.ModeSymlink != 0 {
+		if err := c.fs.Remove(dst); err != nil {
+			return false, err
+		}
+	}
+	srcfd, err := c.fs.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer srcfd.Close()
+	dstfd, err := c.fs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, err
+	}
+	sparse, err := copySparse(dstfd, srcfd, fi)
+	if err == nil && !sparse {
+		_, err = io.Copy(dstfd, srcfd)
+	}
+	if cerr := dstfd.Close(); err == nil {
+		err = cerr
+	}
+	return false, err
+}
+
+// copyMeta gives dst the owner, mode, user xattrs and times of src. The
+// owner is kept where the user is permitted to set it.
+func (c *copier) copyMeta(src, dst string, fi os.FileInfo) error {
+	st, ok := statOf(fi)
+	if ok {
+		if err := c.fs.Lchown(dst, st.uid, st.gid); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+	isLink := fi.Mode()&os.ModeSymlink != 0
+	if !isLink {
+		// an implicit directory of memFs has no permissions to keep.
+		if fi.Mode() != os.ModeDir {
+			if err := c.fs.Chmod(dst, fi.Mode()); err != nil {
+				return err
+			}
+		}
+		if err := c.copyXattrs(src, dst); err != nil {
+			return err
+		}
+	}
+	atime := fi.ModTime()
+	if ok && !st.atime.IsZero() {
+		atime = st.atime
+	}
+	return c.fs.Lchtimes(dst, atime, fi.ModTime())
+}
+
+// copyXattrs copies the user xattrs of src to dst if the FS has them. If
+// the filesystem of dst has none they are left out.
+func (c *copier) copyXattrs(src, dst string) error {
+	x, ok := c.fs.(xattrFS)
+	if !ok {
+		return nil
+	}
+	names, err := x.listXattrs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		data, err := x.getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err := x.setXattr(dst, name, data); errors.Is(err, errNoXattrs) {
+			if c.skip != nil {
+				c.skip(src, "user xattrs, not supported by the destination")
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+//go:build linux
+// +build linux
+
+package backedup
+
+import (
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/sys/unix"
+)
+
+// whence values of lseek for finding the data of sparse files.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Lchtimes implements FS.
+func (fs *osFs) Lchtimes(name string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, name, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "lchtimes", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs *osFs) listXattrs(name string) ([]string, error) {
+	size, err := unix.Llistxattr(name, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: name, Err: err}
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(name, buf); err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: name, Err: err}
+	}
+	return strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00"), nil
+}
+
+func (fs *osFs) getXattr(name, attr string) ([]byte, error) {
+	size, err := unix.Lgetxattr(name, attr, nil)
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr " + attr, Path: name, Err: err}
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Lgetxattr(name, attr, buf); err != nil {
+		return nil, &os.PathError{Op: "getxattr " + attr, Path: name, Err: err}
+	}
+	return buf[:size], nil
+}
+
+func (fs *osFs) setXattr(name, attr string, data []byte) error {
+	err := unix.Lsetxattr(name, attr, data, 0)
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+		return &os.PathError{Op: "setxattr " + attr, Path: name, Err: errNoXattrs}
+	}
+	if err != nil {
+		return &os.PathError{Op: "setxattr " + attr, Path: name, Err: err}
+	}
+	return nil
+}
+
+// statOf returns what the platform knows about fi beyond os.FileInfo.
+func statOf(fi os.FileInfo) (fileStat, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileStat{}, false
+	}
+	return fileStat{
+		uid:   int(st.Uid),
+		gid:   int(st.Gid),
+		dev:   uint64(st.Dev),
+		ino:   uint64(st.Ino),
+		nlink: uint64(st.Nlink),
+		atime: time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec)),
+	}, true
+}
+
+// copySparse copies only the data regions of src to dst if src is a
+// sparse file on disk, so its holes stay holes. It returns false if it
+// didn't copy anything.
+func copySparse(dst, src afero.File, fi os.FileInfo) (bool, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	sf, sok := src.(*os.File)
+	df, dok := dst.(*os.File)
+	if !ok || !sok || !dok || st.Blocks*512 >= fi.Size() {
+		return false, nil
+	}
+	fd := int(sf.Fd())
+	if _, err := unix.Seek(fd, 0, seekData); err != nil && err != unix.ENXIO {
+		// the filesystem can't tell where the data is.
+		return false, nil
+	}
+	size := fi.Size()
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(fd, off, seekData)
+		if err == unix.ENXIO {
+			// only a hole is left.
+			break
+		}
+		if err != nil {
+			return true, &os.PathError{Op: "seek", Path: sf.Name(), Err: err}
+		}
+		hole, err := unix.Seek(fd, data, seekHole)
+		if err != nil {
+			return true, &os.PathError{Op: "seek", Path: sf.Name(), Err: err}
+		}
+		if _, err := sf.Seek(data, io.SeekStart); err != nil {
+			return true, err
+		}
+		if _, err := df.Seek(data, io.SeekStart); err != nil {
+			return true, err
+		}
+		if _, err := io.CopyN(df, sf, hole-data); err != nil {
+			return true, err
+		}
+		off = hole
+	}
+	return true, df.Truncate(size)
+}
@@ -0,0 +1,120 @@
+package backedup
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/sys/unix"
+)
+
+func TestDirCopyOs(t *testing.T) {
+	fs := NewOsFs()
+	tmpDir, err := afero.TempDir(fs, "", "")
+	Ok(t, err)
+	defer fs.RemoveAll(tmpDir)
+	src, dst := filepath.Join(tmpDir, "src"), filepath.Join(tmpDir, "dst")
+	err = fs.MkdirAll(src, 0750)
+	Ok(t, err)
+	atime, mtime := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	err = afero.WriteFile(fs, filepath.Join(src, "a"), []byte("a"), 0640)
+	Ok(t, err)
+	err = fs.Link(filepath.Join(src, "a"), filepath.Join(src, "a.link"))
+	Ok(t, err)
+	err = fs.Chtimes(filepath.Join(src, "a"), atime, mtime)
+	Ok(t, err)
+	err = fs.Symlink("a", filepath.Join(src, "sym"))
+	Ok(t, err)
+	err = fs.Lchtimes(filepath.Join(src, "sym"), atime, mtime)
+	Ok(t, err)
+	xattrs := unix.Lsetxattr(filepath.Join(src, "a"), "user.backedup", []byte("kept"), 0) == nil
+	// 1 MiB with a single byte of data at the end.
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	Ok(t, err)
+	_, err = f.WriteAt([]byte("x"), 1<<20-1)
+	Ok(t, err)
+	Ok(t, f.Close())
+	err = syscall.Mkfifo(filepath.Join(src, "fifo"), 0600)
+	Ok(t, err)
+	l, err := net.Listen("unix", filepath.Join(src, "sock"))
+	Ok(t, err)
+	defer l.Close()
+
+	var log bytes.Buffer
+	b := &Backedup{fs: fs, logger: &log}
+	err = b.copyPath(src, dst)
+	Ok(t, err)
+	Equals(t, []string{
+		"WARN: " + filepath.Join(src, "fifo") + " skipped, fifo",
+		"WARN: " + filepath.Join(src, "sock") + " skipped, socket",
+	}, strings.Split(strings.TrimSpace(log.String()), "\n"))
+	_, err = fs.Lstat(filepath.Join(dst, "fifo"))
+	Equals(t, true, os.IsNotExist(err))
+
+	fi, err := fs.Stat(filepath.Join(dst, "a"))
+	Ok(t, err)
+	Equals(t, os.FileMode(0640), fi.Mode().Perm())
+	Equals(t, mtime, fi.ModTime().UTC())
+	st, _ := statOf(fi)
+	Equals(t, atime, st.atime.UTC())
+	Equals(t, uint64(2), st.nlink)
+	link, err := fs.Stat(filepath.Join(dst, "a.link"))
+	Ok(t, err)
+	Equals(t, true, os.SameFile(fi, link))
+	if xattrs {
+		data, err := fs.(xattrFS).getXattr(filepath.Join(dst, "a"), "user.backedup")
+		Ok(t, err)
+		Equals(t, "kept", string(data))
+	}
+
+	target, err := fs.Readlink(filepath.Join(dst, "sym"))
+	Ok(t, err)
+	Equals(t, "a", target)
+	fi, err = fs.Lstat(filepath.Join(dst, "sym"))
+	Ok(t, err)
+	Equals(t, mtime, fi.ModTime().UTC())
+
+	fi, err = fs.Stat(filepath.Join(dst, "sparse"))
+	Ok(t, err)
+	Equals(t, int64(1<<20), fi.Size())
+	Equals(t, true, fi.Sys().(*syscall.Stat_t).Blocks*512 < fi.Size())
+	data, err := afero.ReadFile(fs, filepath.Join(dst, "sparse"))
+	Ok(t, err)
+	Equals(t, byte('x'), data[len(data)-1])
+
+	fi, err = fs.Stat(dst)
+	Ok(t, err)
+	Equals(t, os.FileMode(0750), fi.Mode().Perm())
+}
+
+func TestDirCopyFailedLink(t *testing.T) {
+	fs := NewOsFs()
+	tmpDir, err := afero.TempDir(fs, "", "")
+	Ok(t, err)
+	defer fs.RemoveAll(tmpDir)
+	src, dst := filepath.Join(tmpDir, "src"), filepath.Join(tmpDir, "dst")
+	err = fs.MkdirAll(src, 0755)
+	Ok(t, err)
+	err = afero.WriteFile(fs, filepath.Join(src, "a"), []byte("a"), 0644)
+	Ok(t, err)
+	err = fs.Link(filepath.Join(src, "a"), filepath.Join(src, "b"))
+	Ok(t, err)
+	// a directory in the way fails the copy of a, b is copied on its own.
+	err = fs.MkdirAll(filepath.Join(dst, "a", "sub"), 0755)
+	Ok(t, err)
+
+	err = DirCopy(src, dst)
+	var cerr *CopyError
+	Equals(t, true, errors.As(err, &cerr))
+	Equals(t, 1, len(cerr.Errors))
+	Equals(t, filepath.Join(src, "a"), cerr.Errors[0].Path)
+	Equals(t, "a", readString(t, fs, filepath.Join(dst, "b")))
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package backedup
+
+import (
+	"os"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Lchtimes implements FS. The times of symlinks can't be set, they are left
+// as they are.
+func (fs *osFs) Lchtimes(name string, atime, mtime time.Time) error {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(name, atime, mtime)
+}
+
+// statOf returns what the platform knows about fi beyond os.FileInfo,
+// nothing outside of linux.
+func statOf(fi os.FileInfo) (fileStat, bool) {
+	return fileStat{}, false
+}
+
+// copySparse doesn't copy anything outside of linux, see the linux version.
+func copySparse(dst, src afero.File, fi os.FileInfo) (bool, error) {
+	return false, nil
+}
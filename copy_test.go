@@ -0,0 +1,98 @@
+package backedup
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestDirCopy(t *testing.T) {
+	fs := NewMemFs()
+	mtime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	err := afero.WriteFile(fs, "/src/sub/a", []byte("a"), 0600)
+	Ok(t, err)
+	err = afero.WriteFile(fs, "/src/b", []byte("b"), 0644)
+	Ok(t, err)
+	err = fs.Symlink("sub/a", "/src/link")
+	Ok(t, err)
+	err = fs.Symlink("/elsewhere", "/src/conflict")
+	Ok(t, err)
+	for _, path := range []string{"/src/sub/a", "/src/link", "/src/sub"} {
+		err = fs.Lchtimes(path, mtime, mtime)
+		Ok(t, err)
+	}
+	// a directory in the way of a symlink fails only that entry.
+	err = fs.MkdirAll("/dst/conflict", 0755)
+	Ok(t, err)
+
+	err = DirCopyFS(fs, "/src", "/dst")
+	var cerr *CopyError
+	Equals(t, true, errors.As(err, &cerr))
+	Equals(t, 1, len(cerr.Errors))
+	Equals(t, "/src/conflict", cerr.Errors[0].Path)
+	Equals(t, true, os.IsExist(errors.Unwrap(cerr.Errors[0])))
+	Equals(t, "b", readString(t, fs, "/dst/b"))
+
+	target, err := fs.Readlink("/dst/link")
+	Ok(t, err)
+	Equals(t, "sub/a", target)
+	fi, err := fs.Lstat("/dst/link")
+	Ok(t, err)
+	Equals(t, mtime, fi.ModTime().UTC())
+	fi, err = fs.Stat("/dst/sub/a")
+	Ok(t, err)
+	Equals(t, os.FileMode(0600), fi.Mode().Perm())
+	Equals(t, mtime, fi.ModTime().UTC())
+	fi, err = fs.Stat("/dst/sub")
+	Ok(t, err)
+	Equals(t, mtime, fi.ModTime().UTC())
+
+	// a symlink at dst is replaced instead of written through.
+	err = fs.Symlink("/src/b", "/copy")
+	Ok(t, err)
+	err = FileCopyFS(fs, "/src/sub/a", "/copy")
+	Ok(t, err)
+	Equals(t, "b", readString(t, fs, "/src/b"))
+	Equals(t, "a", readString(t, fs, "/copy"))
+}
+
+// noXattrFs has user xattrs on /src and none anywhere else.
+type noXattrFs struct {
+	FS
+}
+
+func (fs noXattrFs) listXattrs(name string) ([]string, error) {
+	return []string{"user.backedup"}, nil
+}
+
+func (fs noXattrFs) getXattr(name, attr string) ([]byte, error) {
+	return []byte("kept"), nil
+}
+
+func (fs noXattrFs) setXattr(name, attr string, data []byte) error {
+	return &os.PathError{Op: "setxattr " + attr, Path: name, Err: errNoXattrs}
+}
+
+func TestDirCopyNoXattrs(t *testing.T) {
+	fs := noXattrFs{NewMemFs()}
+	err := afero.WriteFile(fs, "/src/a", []byte("a"), 0644)
+	Ok(t, err)
+	skipped := []string{}
+	err = newCopier(fs, "/src", func(path, reason string) {
+		skipped = append(skipped, path+" "+reason)
+	}).run("/src", "/dst")
+	Ok(t, err)
+	Equals(t, "a", readString(t, fs, "/dst/a"))
+	Equals(t, []string{
+		"/src/a user xattrs, not supported by the destination",
+		"/src user xattrs, not supported by the destination",
+	}, skipped)
+
+	// a directory isn't copied as a file.
+	err = FileCopyFS(fs, "/src", "/copy")
+	Equals(t, true, errors.Is(err, syscall.EISDIR))
+}
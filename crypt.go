@@ -0,0 +1,415 @@
+package backedup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const (
+	// PassphraseEnv is the environment variable with the passphrase for
+	// encrypted paths.
+	PassphraseEnv = "BACKEDUP_PASSPHRASE"
+	// keyPrefix starts the key line of a key file.
+	keyPrefix = "BACKEDUP-SECRET-KEY-"
+	// encMagic starts every encrypted file.
+	encMagic = "backedup-encrypted-v1\n"
+	// encKindKey and encKindPassphrase tell how the key of a file is made.
+	encKindKey        = 'k'
+	encKindPassphrase = 'p'
+	saltSize          = 16
+)
+
+// crypter encrypts and decrypts files with a key from a key file or one
+// derived from a passphrase.
+type crypter struct {
+	// key is the key of a key file.
+	key []byte
+	// passphrase is used if there is no key.
+	passphrase []byte
+	// salt is used for every file encrypted with the passphrase in a run so
+	// the key is derived once.
+	salt []byte
+	// keys are the derived keys by salt.
+	keys map[string][]byte
+}
+
+// GenerateKeyFile writes a new random key to path, readable only by the
+// owner.
+func GenerateKeyFile(fs FS, path string) error {
+	if _, err := fs.Lstat(path); err == nil {
+		return fmt.Errorf("%s %s", path, ErrFileExists)
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	data := fmt.Sprintf("# backedup key, created %s\n%s%s\n",
+		time.Now().Format(time.RFC3339), keyPrefix, base64.RawStdEncoding.EncodeToString(key))
+	return afero.WriteFile(fs, path, []byte(data), 0600)
+}
+
+// readKeyFile returns the key of a key file, lines starting with # are
+// comments.
+func readKeyFile(fs FS, path string) ([]byte, error) {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, keyPrefix) {
+			break
+		}
+		key, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(line, keyPrefix))
+		if err != nil || len(key) != chacha20poly1305.KeySize {
+			break
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s is not a key file", path)
+}
+
+// crypter returns the crypter for encrypted paths. The key comes from
+// Config.KeyFile, the passphrase from PassphraseEnv or else a prompt unless
+// Backedup.NoPrompt is set.
+func (b *Backedup) crypter() (*crypter, error) {
+	if b.crypt != nil {
+		return b.crypt, nil
+	}
+	c := &crypter{keys: map[string][]byte{}}
+	switch {
+	case b.Config.KeyFile != "":
+		key, err := readKeyFile(b.fs, b.Config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.key = key
+	case os.Getenv(PassphraseEnv) != "":
+		c.passphrase = []byte(os.Getenv(PassphraseEnv))
+	case b.NoPrompt:
+		return nil, ErrNoPassphrase
+	default:
+		passphrase, err := b.readPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		c.passphrase = passphrase
+	}
+	b.crypt = c
+	return c, nil
+}
+
+// readPassphrase asks for the passphrase on stdin, without echoing it if
+// stdin is a terminal.
+func (b *Backedup) readPassphrase() ([]byte, error) {
+	fmt.Fprint(b.logger, "passphrase for encrypted paths: ")
+	var text string
+	if b.tty != nil {
+		data, err := term.ReadPassword(int(b.tty.Fd()))
+		fmt.Fprintln(b.logger)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	} else {
+		var err error
+		if text, err = b.stdin.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+	text = strings.TrimRight(text, "\r\n")
+	if text == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	return []byte(text), nil
+}
+
+// deriveKey returns the key for the passphrase and salt.
+func (c *crypter) deriveKey(salt []byte) ([]byte, error) {
+	if key, ok := c.keys[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key(c.passphrase, salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	c.keys[string(salt)] = key
+	return key, nil
+}
+
+// encrypt returns the header, nonce and ciphertext of plain. The header is
+// authenticated too.
+func (c *crypter) encrypt(plain []byte) ([]byte, error) {
+	header := []byte(encMagic)
+	key := c.key
+	if key == nil {
+		if c.salt == nil {
+			c.salt = make([]byte, saltSize)
+			if _, err := rand.Read(c.salt); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if key, err = c.deriveKey(c.salt); err != nil {
+			return nil, err
+		}
+		header = append(append(header, encKindPassphrase), c.salt...)
+	} else {
+		header = append(header, encKindKey)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, header...), nonce...)
+	return aead.Seal(out, nonce, plain, header), nil
+}
+
+// decrypt returns the plaintext of data returned by encrypt.
+func (c *crypter) decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encMagic)) || len(data) <= len(encMagic) {
+		return nil, ErrNotEncrypted
+	}
+	headerSize := len(encMagic) + 1
+	var key []byte
+	switch data[len(encMagic)] {
+	case encKindKey:
+		if c.key == nil {
+			return nil, errors.New("encrypted with a key file, not a passphrase")
+		}
+		key = c.key
+	case encKindPassphrase:
+		if c.passphrase == nil {
+			return nil, errors.New("encrypted with a passphrase, not a key file")
+		}
+		headerSize += saltSize
+		if len(data) < headerSize {
+			return nil, ErrNotEncrypted
+		}
+		var err error
+		if key, err = c.deriveKey(data[headerSize-saltSize : headerSize]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrNotEncrypted
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerSize+aead.NonceSize() {
+		return nil, ErrNotEncrypted
+	}
+	header := data[:headerSize]
+	nonce := data[headerSize : headerSize+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[headerSize+aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// encryptFile encrypts the file src into dst.
+func (b *Backedup) encryptFile(src, dst string) error {
+	c, err := b.crypter()
+	if err != nil {
+		return err
+	}
+	plain, err := afero.ReadFile(b.fs, src)
+	if err != nil {
+		return err
+	}
+	data, err := c.encrypt(plain)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.fs, dst, data, 0600)
+}
+
+// decryptFile decrypts the file src into dst, readable only by the owner.
+func (b *Backedup) decryptFile(src, dst string) error {
+	c, err := b.crypter()
+	if err != nil {
+		return err
+	}
+	data, err := afero.ReadFile(b.fs, src)
+	if err != nil {
+		return err
+	}
+	plain, err := c.decrypt(data)
+	if err != nil {
+		return fmt.Errorf("%s %w", src, err)
+	}
+	return writeFileAtomic(b.fs, dst, plain, 0600)
+}
+
+// sameEncrypted reports whether the encrypted file backup decrypts to the
+// content of live.
+func (b *Backedup) sameEncrypted(live, backup string) (bool, error) {
+	c, err := b.crypter()
+	if err != nil {
+		return false, err
+	}
+	data, err := afero.ReadFile(b.fs, backup)
+	if err != nil {
+		return false, err
+	}
+	plain, err := c.decrypt(data)
+	if err != nil {
+		return false, fmt.Errorf("%s %w", backup, err)
+	}
+	current, err := afero.ReadFile(b.fs, live)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(plain, current), nil
+}
+
+// planBackupEncrypt adds the actions that encrypt the files of an encrypted
+// path that are new or changed into the backup directory. The local files
+// stay in place.
+func (b *Backedup) planBackupEncrypt(plan *Plan, p PathConfig) bool {
+	if _, err := b.crypter(); errors.Is(err, ErrNoPassphrase) {
+		plan.skip(p.Path, "encrypted, no passphrase to compare")
+		return false
+	} else if err != nil {
+		plan.fail(p.Path, err)
+		return false
+	}
+	files, err := listFiles(b.fs, p.Path, b.excludes(p))
+	if err != nil {
+		plan.fail(p.Path, err)
+		return false
+	}
+	backupPath := b.backupPath(p.Path)
+	n := len(*plan)
+	for _, rel := range unionFiles(files, nil) {
+		live, backup := filepath.Join(p.Path, rel), filepath.Join(backupPath, rel)
+		replace := false
+		if _, err := b.fs.Lstat(backup); err == nil {
+			same, err := b.sameEncrypted(live, backup)
+			if err != nil {
+				plan.fail(live, err)
+				continue
+			}
+			if same {
+				continue
+			}
+			replace = true
+		}
+		*plan = append(*plan, Action{Type: ActionEncrypt, Path: live, Src: live, Dst: backup, Replace: replace})
+	}
+	if len(*plan) == n {
+		plan.skip(p.Path, "already backed up")
+	}
+	return true
+}
+
+// planRestoreEncrypt adds the actions that decrypt the files of an
+// encrypted path that are missing or differ locally, it returns false if
+// the path failed or was left alone.
+func (b *Backedup) planRestoreEncrypt(plan *Plan, p PathConfig, backupPath string) bool {
+	path := p.Path
+	if _, err := b.fs.Lstat(backupPath); err != nil {
+		if os.IsNotExist(err) && p.Optional {
+			plan.skip(path, "optional, not backed up")
+			return false
+		}
+		plan.fail(path, fmt.Errorf("backup path doesn't exist %s", backupPath))
+		return false
+	}
+	if _, err := b.crypter(); errors.Is(err, ErrNoPassphrase) {
+		plan.skip(path, "encrypted, no passphrase to compare")
+		return false
+	} else if err != nil {
+		plan.fail(path, err)
+		return false
+	}
+	files, err := listFiles(b.fs, backupPath, b.excludes(p))
+	if err != nil {
+		plan.fail(path, err)
+		return false
+	}
+	n := len(*plan)
+	for _, rel := range unionFiles(files, nil) {
+		live, backup := filepath.Join(path, rel), filepath.Join(backupPath, rel)
+		fi, err := b.fs.Lstat(live)
+		if err != nil && !os.IsNotExist(err) {
+			plan.fail(live, err)
+			continue
+		}
+		if err == nil {
+			target := ""
+			if fi.Mode()&os.ModeSymlink != 0 {
+				target, _ = b.fs.Readlink(live)
+			} else if same, err := b.sameEncrypted(live, backup); err != nil {
+				plan.fail(live, err)
+				continue
+			} else if same {
+				continue
+			}
+			c := p
+			c.Path = live
+			if !b.planConflict(plan, c, target) {
+				continue
+			}
+		}
+		plan.add(ActionDecrypt, live, backup, live)
+	}
+	if len(*plan) == n {
+		plan.skip(path, "up to date")
+	}
+	return true
+}
+
+// encryptedStatus returns StateEncrypted if every file of an encrypted path
+// is the same locally and in the backup, StateUnverified if there is no
+// passphrase to tell.
+func (b *Backedup) encryptedStatus(p PathConfig, backupPath string) (PathState, error) {
+	m := b.excludes(p)
+	liveFiles, err := listFiles(b.fs, p.Path, m)
+	if err != nil {
+		return "", err
+	}
+	backupFiles, err := listFiles(b.fs, backupPath, m)
+	if err != nil {
+		return "", err
+	}
+	for _, rel := range unionFiles(liveFiles, backupFiles) {
+		if !liveFiles[rel] || !backupFiles[rel] {
+			return StateOutOfSync, nil
+		}
+		same, err := b.sameEncrypted(filepath.Join(p.Path, rel), filepath.Join(backupPath, rel))
+		if errors.Is(err, ErrNoPassphrase) {
+			return StateUnverified, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !same {
+			return StateOutOfSync, nil
+		}
+	}
+	return StateEncrypted, nil
+}
@@ -0,0 +1,137 @@
+package backedup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestCrypter(t *testing.T) {
+	fs := NewMemFs()
+	err := GenerateKeyFile(fs, "/key")
+	Ok(t, err)
+	err = GenerateKeyFile(fs, "/key")
+	Equals(t, true, err != nil)
+	key, err := readKeyFile(fs, "/key")
+	Ok(t, err)
+
+	for _, c := range []*crypter{
+		{key: key, keys: map[string][]byte{}},
+		{passphrase: []byte("secret"), keys: map[string][]byte{}},
+	} {
+		data, err := c.encrypt([]byte("plain"))
+		Ok(t, err)
+		Equals(t, false, strings.Contains(string(data), "plain"))
+		plain, err := c.decrypt(data)
+		Ok(t, err)
+		Equals(t, "plain", string(plain))
+
+		// any change to the file is detected.
+		data[len(data)-1] ^= 1
+		_, err = c.decrypt(data)
+		Equals(t, ErrDecrypt, err)
+	}
+	other := &crypter{passphrase: []byte("other"), keys: map[string][]byte{}}
+	data, err := (&crypter{passphrase: []byte("secret"), keys: map[string][]byte{}}).encrypt([]byte("plain"))
+	Ok(t, err)
+	_, err = other.decrypt(data)
+	Equals(t, ErrDecrypt, err)
+	_, err = other.decrypt([]byte("plain"))
+	Equals(t, ErrNotEncrypted, err)
+}
+
+func TestEncrypt(t *testing.T) {
+	b, tmpDir, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+key_file: %[1]s/key
+paths:
+  - path: $HOME/.ssh
+    encrypt: true`)
+	defer cleanup()
+	err := GenerateKeyFile(b.fs, filepath.Join(tmpDir, "key"))
+	Ok(t, err)
+	ssh := b.Config.Paths[0].Path
+	key := filepath.Join(ssh, "id_ed25519")
+	err = afero.WriteFile(b.fs, key, []byte("private key"), 0600)
+	Ok(t, err)
+
+	// the backup is encrypted and the local files stay.
+	err = b.Backup()
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, key)
+	Equals(t, false, strings.Contains(readString(t, b.fs, b.backupPath(key)), "private key"))
+	statuses, err := b.Status()
+	Ok(t, err)
+	Equals(t, StateEncrypted, statuses[0].State)
+	plan, err := b.PlanBackup()
+	Ok(t, err)
+	Equals(t, Plan{{Type: ActionSkip, Path: ssh, Reason: "already backed up"}}, plan)
+
+	// a changed file is encrypted again.
+	err = afero.WriteFile(b.fs, key, []byte("new key"), 0600)
+	Ok(t, err)
+	statuses, err = b.Status()
+	Ok(t, err)
+	Equals(t, StateOutOfSync, statuses[0].State)
+	err = b.Backup()
+	Ok(t, err)
+
+	// restore decrypts into files readable only by the owner.
+	err = b.fs.RemoveAll(ssh)
+	Ok(t, err)
+	err = b.Restore()
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, key)
+	Equals(t, "new key", readString(t, b.fs, key))
+	fi, err := b.fs.Stat(key)
+	Ok(t, err)
+	Equals(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// a different key can't decrypt the backup.
+	err = GenerateKeyFile(b.fs, filepath.Join(tmpDir, "other"))
+	Ok(t, err)
+	other, err := readKeyFile(b.fs, filepath.Join(tmpDir, "other"))
+	Ok(t, err)
+	b.crypt = &crypter{key: other, keys: map[string][]byte{}}
+	err = afero.WriteFile(b.fs, key, []byte("local"), 0600)
+	Ok(t, err)
+	err = b.Restore()
+	checkFailedPaths(t, err, key)
+	Equals(t, true, errors.Is(err, ErrDecrypt))
+}
+
+func TestEncryptNoPrompt(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - path: $HOME/.ssh
+    encrypt: true`)
+	defer cleanup()
+	os.Unsetenv(PassphraseEnv)
+	ssh := b.Config.Paths[0].Path
+	err := afero.WriteFile(b.fs, filepath.Join(ssh, "id_ed25519"), []byte("private key"), 0600)
+	Ok(t, err)
+	b.stdin.Reset(strings.NewReader("secret\n"))
+	err = b.Backup()
+	Ok(t, err)
+
+	// -dry-run and -status don't ask for the passphrase.
+	b.crypt = nil
+	b.NoPrompt = true
+	b.stdin.Reset(strings.NewReader("secret\n"))
+	statuses, err := b.Status()
+	Ok(t, err)
+	Equals(t, StateUnverified, statuses[0].State)
+	plan, err := b.PlanBackup()
+	Ok(t, err)
+	Equals(t, Plan{{Type: ActionSkip, Path: ssh, Reason: "encrypted, no passphrase to compare"}}, plan)
+
+	b.NoPrompt = false
+	statuses, err = b.Status()
+	Ok(t, err)
+	Equals(t, StateEncrypted, statuses[0].State)
+}
@@ -0,0 +1,95 @@
+package backedup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// OpError is the failure of a single configured path.
+type OpError struct {
+	// Op is the action that failed, ActionSkip if the path failed while
+	// planning.
+	Op ActionType
+	// Path is the configured path.
+	Path string
+	// Err is the cause.
+	Err error
+}
+
+// Error implements error.
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Path, e.Err)
+}
+
+// Unwrap returns the cause.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError collects the failed paths of an operation. errors.Is and
+// errors.As match against every failure.
+type MultiError struct {
+	// Op is the operation, for example "backup".
+	Op string
+	// Errors are the failed paths in order.
+	Errors []*OpError
+	// Total is the number of paths the operation handled.
+	Total int
+}
+
+// Error implements error.
+func (e *MultiError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	op := e.Op
+	if op == "" {
+		op = "apply"
+	}
+	return fmt.Sprintf("%s failed for %d of %d paths: %s", op, len(e.Errors), e.Total, strings.Join(msgs, "; "))
+}
+
+// Is reports whether any of the failures matches target.
+func (e *MultiError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first failure that matches target.
+func (e *MultiError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Partial reports whether some of the paths succeeded. A path can fail
+// more than once, like a step and its rollback.
+func (e *MultiError) Partial() bool {
+	failed := map[string]bool{}
+	for _, err := range e.Errors {
+		failed[err.Path] = true
+	}
+	return len(failed) < e.Total
+}
+
+// add records the failure of path.
+func (e *MultiError) add(op ActionType, path string, err error) {
+	e.Errors = append(e.Errors, &OpError{Op: op, Path: path, Err: err})
+}
+
+// errOrNil returns e if any path failed.
+func (e *MultiError) errOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
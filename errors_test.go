@@ -0,0 +1,31 @@
+package backedup
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestMultiError(t *testing.T) {
+	errs := &MultiError{Op: "backup", Total: 3}
+	Equals(t, nil, errs.errOrNil())
+
+	errs.add(ActionSkip, "/a", ErrSymlinkExists)
+	errs.add(ActionMove, "/b", &os.PathError{Op: "rename", Path: "/b", Err: os.ErrPermission})
+	var err error = errs
+	Equals(t, "backup failed for 2 of 3 paths: skip /a: symlink exists; move /b: rename /b: permission denied", err.Error())
+	Equals(t, true, errors.Is(err, ErrSymlinkExists))
+	Equals(t, true, errors.Is(err, os.ErrPermission))
+	Equals(t, false, errors.Is(err, ErrFileExists))
+	Equals(t, true, errs.Partial())
+
+	var opErr *OpError
+	Equals(t, true, errors.As(err, &opErr))
+	Equals(t, "/a", opErr.Path)
+	var pathErr *os.PathError
+	Equals(t, true, errors.As(err, &pathErr))
+	Equals(t, "rename", pathErr.Op)
+
+	errs.add(ActionSymlink, "/c", ErrFileExists)
+	Equals(t, false, errs.Partial())
+}
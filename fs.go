@@ -0,0 +1,382 @@
+package backedup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// maxSymlinkHops is the number of symlinks followed before resolving a path
+// fails, like ELOOP on linux.
+const maxSymlinkHops = 40
+
+// FS is the filesystem backedup works on. It adds symlink support to
+// afero.Fs, Stat and Open follow symlinks while Lstat, Readlink, Remove and
+// Rename work on the symlink itself.
+type FS interface {
+	afero.Fs
+	// Lstat returns the FileInfo of name without following a symlink.
+	Lstat(name string) (os.FileInfo, error)
+	// Symlink creates newname as a symlink to oldname.
+	Symlink(oldname, newname string) error
+	// Readlink returns the target of the symlink name.
+	Readlink(name string) (string, error)
+	// Link creates newname as a hard link to the file oldname.
+	Link(oldname, newname string) error
+	// Lchtimes changes the access and modification times of name without
+	// following a symlink.
+	Lchtimes(name string, atime, mtime time.Time) error
+	// Lchown changes the owner and group of name without following a
+	// symlink.
+	Lchown(name string, uid, gid int) error
+}
+
+// osFs is the FS of the operating system.
+type osFs struct {
+	afero.OsFs
+}
+
+// NewOsFs returns the FS of the operating system.
+func NewOsFs() FS {
+	return &osFs{}
+}
+
+// Lstat implements FS.
+func (fs *osFs) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// Symlink implements FS.
+func (fs *osFs) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+// Readlink implements FS.
+func (fs *osFs) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+// Link implements FS.
+func (fs *osFs) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+// Lchown implements FS.
+func (fs *osFs) Lchown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
+// memFs is an in memory FS. Symlinks are stored as files with the
+// os.ModeSymlink mode bit set and their target as content, every path is
+// resolved through them before it is handed to afero.MemMapFs.
+type memFs struct {
+	mem *afero.MemMapFs
+}
+
+// NewMemFs returns an empty in memory FS.
+func NewMemFs() FS {
+	return &memFs{mem: &afero.MemMapFs{}}
+}
+
+// resolve follows the symlinks in every element of name. If follow is false
+// a symlink in the last element is not followed. Missing elements are kept
+// as they are so the result can be used to create files.
+func (fs *memFs) resolve(name string, follow bool) (string, error) {
+	name = filepath.Clean(name)
+	for hops := 0; hops <= maxSymlinkHops; hops++ {
+		parts := strings.Split(strings.TrimPrefix(name, string(filepath.Separator)), string(filepath.Separator))
+		cur := string(filepath.Separator)
+		if !filepath.IsAbs(name) {
+			cur = ""
+		}
+		restarted := false
+		for i, part := range parts {
+			next := filepath.Join(cur, part)
+			fi, err := fs.mem.Stat(next)
+			if err != nil {
+				// the rest doesn't exist, nothing left to follow.
+				return filepath.Join(append([]string{next}, parts[i+1:]...)...), nil
+			}
+			last := i == len(parts)-1
+			if fi.Mode()&os.ModeSymlink == 0 || (last && !follow) {
+				cur = next
+				continue
+			}
+			target, err := afero.ReadFile(fs.mem, next)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(string(target)) {
+				target = []byte(filepath.Join(cur, string(target)))
+			}
+			name = filepath.Join(append([]string{string(target)}, parts[i+1:]...)...)
+			restarted = true
+			break
+		}
+		if !restarted {
+			return cur, nil
+		}
+	}
+	return "", &os.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+}
+
+// Create implements afero.Fs.
+func (fs *memFs) Create(name string) (afero.File, error) {
+	path, err := fs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.mem.Create(path)
+}
+
+// Mkdir implements afero.Fs.
+func (fs *memFs) Mkdir(name string, perm os.FileMode) error {
+	path, err := fs.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return fs.mem.Mkdir(path, perm)
+}
+
+// MkdirAll implements afero.Fs.
+func (fs *memFs) MkdirAll(name string, perm os.FileMode) error {
+	path, err := fs.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return fs.mem.MkdirAll(path, perm)
+}
+
+// Open implements afero.Fs.
+func (fs *memFs) Open(name string) (afero.File, error) {
+	path, err := fs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.mem.Open(path)
+}
+
+// OpenFile implements afero.Fs.
+func (fs *memFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	path, err := fs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.mem.OpenFile(path, flag, perm)
+}
+
+// Remove implements afero.Fs.
+func (fs *memFs) Remove(name string) error {
+	path, err := fs.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return fs.mem.Remove(path)
+}
+
+// RemoveAll implements afero.Fs.
+func (fs *memFs) RemoveAll(name string) error {
+	path, err := fs.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return fs.removeAll(path)
+}
+
+// removeAll removes path and everything under it. afero.MemMapFs.RemoveAll
+// removes every path with the same string prefix, so /a/.zsh would take
+// /a/.zshrc with it.
+func (fs *memFs) removeAll(path string) error {
+	paths := []string{}
+	err := afero.Walk(fs.mem, path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// children are walked after their parents.
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := fs.mem.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename implements afero.Fs. Unlike afero.MemMapFs it moves the contents
+// of directories too.
+func (fs *memFs) Rename(oldname, newname string) error {
+	oldpath, err := fs.resolve(oldname, false)
+	if err != nil {
+		return err
+	}
+	newpath, err := fs.resolve(newname, false)
+	if err != nil {
+		return err
+	}
+	fi, err := fs.mem.Stat(oldpath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, err := fs.mem.Stat(filepath.Dir(newpath)); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if !fi.IsDir() {
+		return fs.mem.Rename(oldpath, newpath)
+	}
+	if oldpath == newpath || strings.HasPrefix(newpath, oldpath+string(filepath.Separator)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+	err = afero.Walk(fs.mem, oldpath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(newpath, strings.TrimPrefix(path, oldpath))
+		if !info.IsDir() {
+			return fs.mem.Rename(path, dst)
+		}
+		if err := fs.mem.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return fs.mem.Chmod(dst, info.Mode())
+	})
+	if err != nil {
+		return err
+	}
+	return fs.removeAll(oldpath)
+}
+
+// Stat implements afero.Fs.
+func (fs *memFs) Stat(name string) (os.FileInfo, error) {
+	path, err := fs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fs.mem.Stat(path)
+}
+
+// Name implements afero.Fs.
+func (fs *memFs) Name() string {
+	return "memFs"
+}
+
+// Chmod implements afero.Fs.
+func (fs *memFs) Chmod(name string, mode os.FileMode) error {
+	path, err := fs.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	fi, err := fs.mem.Stat(path)
+	if err != nil {
+		return err
+	}
+	// keep the type bits, only the permissions change.
+	return fs.mem.Chmod(path, fi.Mode()&^os.ModePerm|mode&os.ModePerm)
+}
+
+// Chtimes implements afero.Fs.
+func (fs *memFs) Chtimes(name string, atime, mtime time.Time) error {
+	path, err := fs.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	return fs.mem.Chtimes(path, atime, mtime)
+}
+
+// Lchtimes implements FS.
+func (fs *memFs) Lchtimes(name string, atime, mtime time.Time) error {
+	path, err := fs.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return fs.mem.Chtimes(path, atime, mtime)
+}
+
+// Lchown implements FS. Owners aren't kept, it only checks that name
+// exists.
+func (fs *memFs) Lchown(name string, uid, gid int) error {
+	_, err := fs.Lstat(name)
+	return err
+}
+
+// Lstat implements FS.
+func (fs *memFs) Lstat(name string) (os.FileInfo, error) {
+	path, err := fs.resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fs.mem.Stat(path)
+}
+
+// LstatIfPossible implements afero.Lstater so afero.Walk doesn't follow
+// symlinks, like it does for afero.OsFs.
+func (fs *memFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, err := fs.Lstat(name)
+	return fi, true, err
+}
+
+// Symlink implements FS.
+func (fs *memFs) Symlink(oldname, newname string) error {
+	path, err := fs.resolve(newname, false)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.mem.Stat(path); err == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if _, err := fs.mem.Stat(filepath.Dir(path)); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if err := afero.WriteFile(fs.mem, path, []byte(oldname), 0777); err != nil {
+		return err
+	}
+	return fs.mem.Chmod(path, os.ModeSymlink|0777)
+}
+
+// Readlink implements FS.
+func (fs *memFs) Readlink(name string) (string, error) {
+	path, err := fs.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	fi, err := fs.mem.Stat(path)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrNotExist}
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	target, err := afero.ReadFile(fs.mem, path)
+	return string(target), err
+}
+
+// Link implements FS. afero.MemMapFs can't share a file between two names,
+// newname gets a copy of the content and mode of oldname instead.
+func (fs *memFs) Link(oldname, newname string) error {
+	fi, err := fs.Lstat(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if !fi.Mode().IsRegular() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	if _, err := fs.Lstat(newname); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	data, err := afero.ReadFile(fs, oldname)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, newname, data, fi.Mode())
+}
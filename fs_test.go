@@ -0,0 +1,112 @@
+package backedup
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestMemFsSymlink(t *testing.T) {
+	fs := NewMemFs()
+	err := fs.MkdirAll("/backup/dir", 0755)
+	Ok(t, err)
+	err = afero.WriteFile(fs, "/backup/dir/file", []byte("contents"), 0644)
+	Ok(t, err)
+	err = fs.MkdirAll("/home", 0755)
+	Ok(t, err)
+
+	err = fs.Symlink("/backup/dir", "/home/dir")
+	Ok(t, err)
+	err = fs.Symlink("dir/file", "/home/relative")
+	Ok(t, err)
+	Equals(t, true, os.IsExist(fs.Symlink("/backup", "/home/dir")))
+
+	// reads and writes go through symlinks
+	data, err := afero.ReadFile(fs, "/home/dir/file")
+	Ok(t, err)
+	Equals(t, "contents", string(data))
+	data, err = afero.ReadFile(fs, "/home/relative")
+	Ok(t, err)
+	Equals(t, "contents", string(data))
+	err = afero.WriteFile(fs, "/home/dir/new", []byte("new"), 0644)
+	Ok(t, err)
+	data, err = afero.ReadFile(fs, "/backup/dir/new")
+	Ok(t, err)
+	Equals(t, "new", string(data))
+
+	fi, err := fs.Lstat("/home/dir")
+	Ok(t, err)
+	Equals(t, os.ModeSymlink, fi.Mode()&os.ModeSymlink)
+	fi, err = fs.Stat("/home/dir")
+	Ok(t, err)
+	Equals(t, true, fi.IsDir())
+	target, err := fs.Readlink("/home/dir")
+	Ok(t, err)
+	Equals(t, "/backup/dir", target)
+	_, err = fs.Readlink("/backup/dir")
+	Equals(t, true, err != nil)
+
+	// removing the symlink leaves the target
+	err = fs.Remove("/home/dir")
+	Ok(t, err)
+	exists, err := afero.Exists(fs, "/backup/dir/file")
+	Ok(t, err)
+	Equals(t, true, exists)
+
+	// dangling symlinks and loops
+	err = fs.Symlink("/nothing", "/home/dangling")
+	Ok(t, err)
+	_, err = fs.Stat("/home/dangling")
+	Equals(t, true, os.IsNotExist(err))
+	_, err = fs.Lstat("/home/dangling")
+	Ok(t, err)
+	err = fs.Symlink("/home/loop2", "/home/loop1")
+	Ok(t, err)
+	err = fs.Symlink("/home/loop1", "/home/loop2")
+	Ok(t, err)
+	_, err = fs.Stat("/home/loop1")
+	Equals(t, true, err != nil)
+}
+
+func TestMemFsRenameDir(t *testing.T) {
+	fs := NewMemFs()
+	err := fs.MkdirAll("/home/.vim/bundle", 0700)
+	Ok(t, err)
+	err = afero.WriteFile(fs, "/home/.vim/bundle/plugin.vim", []byte("plugin"), 0644)
+	Ok(t, err)
+	err = fs.Symlink("bundle/plugin.vim", "/home/.vim/link")
+	Ok(t, err)
+	err = fs.MkdirAll("/backup", 0755)
+	Ok(t, err)
+
+	err = fs.Rename("/home/.vim", "/backup/.vim")
+	Ok(t, err)
+	Equals(t, []string{
+		"/backup",
+		"/backup/.vim",
+		"/backup/.vim/bundle",
+		"/backup/.vim/bundle/plugin.vim",
+		"/backup/.vim/link",
+	}, getFs(fs, "/backup"))
+	exists, err := afero.Exists(fs, "/home/.vim")
+	Ok(t, err)
+	Equals(t, false, exists)
+	fi, err := fs.Stat("/backup/.vim/bundle")
+	Ok(t, err)
+	Equals(t, os.FileMode(0700), fi.Mode().Perm())
+	data, err := afero.ReadFile(fs, "/backup/.vim/link")
+	Ok(t, err)
+	Equals(t, "plugin", string(data))
+}
+
+func TestMemFsRemoveAllPrefix(t *testing.T) {
+	fs := NewMemFs()
+	err := afero.WriteFile(fs, "/home/.zsh/plugin.zsh", []byte("plugin"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(fs, "/home/.zshrc", []byte("zshrc"), 0644)
+	Ok(t, err)
+	err = fs.RemoveAll("/home/.zsh")
+	Ok(t, err)
+	Equals(t, []string{"/home", "/home/.zshrc"}, getFs(fs, "/home"))
+}
@@ -0,0 +1,194 @@
+package backedup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Backend is how the history of the backup directory is kept.
+type Backend string
+
+const (
+	// BackendNone keeps no history, this is the default.
+	BackendNone Backend = ""
+	// BackendGit makes the backup directory a git repository and commits
+	// every change to it.
+	BackendGit Backend = "git"
+)
+
+// validate returns an error for unknown backends.
+func (be Backend) validate() error {
+	switch be {
+	case BackendNone, BackendGit:
+		return nil
+	}
+	return fmt.Errorf("unknown backend %q", be)
+}
+
+// GitConfig are the options of BackendGit.
+type GitConfig struct {
+	// PostCommit is a shell command run in the backup directory after every
+	// commit, e.g. to push it.
+	PostCommit string `json:"post_commit,omitempty" yaml:"post_commit,omitempty"`
+}
+
+// Commit is a commit of the backup directory.
+type Commit struct {
+	// Hash is the commit hash.
+	Hash string `json:"hash"`
+	// Time is the author time.
+	Time time.Time `json:"time"`
+	// Subject is the first line of the message.
+	Subject string `json:"subject"`
+}
+
+// git runs git in the backup directory and returns its output.
+func (b *Backedup) git(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = b.Config.BackupTo
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s %s %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// gitInit makes the backup directory a git repository unless it is one.
+// The files backedup keeps for itself are not committed.
+func (b *Backedup) gitInit() error {
+	if _, err := os.Stat(filepath.Join(b.Config.BackupTo, ".git")); err == nil {
+		return nil
+	}
+	if _, err := b.git("init", "-q"); err != nil {
+		return err
+	}
+	exclude := filepath.Join(b.Config.BackupTo, ".git", "info", "exclude")
+	if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(exclude, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, "/.backedup-*")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Commit stages every change of the backup directory and commits it with a
+// message listing the changed files. It reports whether there was anything
+// to commit. Config.Git.PostCommit runs after the commit. git works on the
+// directory itself, not through the FS of b.
+func (b *Backedup) Commit() (bool, error) {
+	return b.commit("commit")
+}
+
+// commit commits the changes made by the operation op.
+func (b *Backedup) commit(op string) (bool, error) {
+	if b.Config.Backend != BackendGit {
+		return false, fmt.Errorf("backend is not %s", BackendGit)
+	}
+	if err := b.checkBackupTo(); err != nil {
+		return false, err
+	}
+	if err := b.gitInit(); err != nil {
+		return false, err
+	}
+	// the edits made through the symlinks are recorded with the commit.
+	if err := b.writeManifest(); err != nil {
+		return false, err
+	}
+	if _, err := b.git("add", "-A"); err != nil {
+		return false, err
+	}
+	status, err := b.git("status", "--porcelain")
+	if err != nil {
+		return false, err
+	}
+	changes := strings.Split(strings.TrimRight(status, "\n"), "\n")
+	if status == "" {
+		return false, nil
+	}
+	files := "files"
+	if len(changes) == 1 {
+		files = "file"
+	}
+	msg := fmt.Sprintf("%s on %s, %d %s changed\n\n%s\n", op, b.hostname, len(changes), files, strings.Join(changes, "\n"))
+	args := []string{"commit", "-q", "-m", msg}
+	// a fresh machine may have no identity, git refuses to commit then.
+	if name, _ := b.git("config", "user.name"); name == "" {
+		args = append([]string{"-c", "user.name=backedup"}, args...)
+	}
+	if email, _ := b.git("config", "user.email"); email == "" {
+		args = append([]string{"-c", "user.email=backedup@" + b.hostname}, args...)
+	}
+	if _, err := b.git(args...); err != nil {
+		return false, err
+	}
+	if b.Config.Git.PostCommit == "" {
+		return true, nil
+	}
+	cmd := exec.Command("sh", "-c", b.Config.Git.PostCommit)
+	cmd.Dir = b.Config.BackupTo
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return true, fmt.Errorf("post_commit %s %s", err, strings.TrimSpace(string(out)))
+	}
+	return true, nil
+}
+
+// autoCommit commits the backup directory after the operation op returned
+// err, if the backend is git. Partial changes are committed too.
+func (b *Backedup) autoCommit(op string, err error) error {
+	if b.Config.Backend != BackendGit {
+		return err
+	}
+	if _, cerr := b.commit(op); cerr != nil && err == nil {
+		return cerr
+	}
+	return err
+}
+
+// Log returns the commits that changed the backup of path or its variant
+// for this host, newest first.
+func (b *Backedup) Log(path string) ([]Commit, error) {
+	if b.Config.Backend != BackendGit {
+		return nil, fmt.Errorf("backend is not %s", BackendGit)
+	}
+	path = os.ExpandEnv(path)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	args := []string{"log", "--format=%H%x00%aI%x00%s", "--"}
+	for _, backupPath := range []string{b.backupPath(path), b.hostPath(path)} {
+		rel, err := filepath.Rel(b.Config.BackupTo, backupPath)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, filepath.ToSlash(rel))
+	}
+	out, err := b.git(args...)
+	if err != nil {
+		return nil, err
+	}
+	commits := []Commit{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		parts := strings.SplitN(line, "\x00", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, Commit{Hash: parts[0], Time: t, Subject: parts[2]})
+	}
+	return commits, nil
+}
@@ -0,0 +1,58 @@
+package backedup
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestGitBackend(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	b, tmpDir, cleanup := newTestBackedup(t, NewOsFs(), `
+backup_to: %[1]s/backedup
+backend: git
+git:
+  post_commit: touch ../pushed
+paths:
+  - $HOME/.zshrc
+  - $HOME/.vimrc`)
+	defer cleanup()
+	zshrc, vimrc := b.Config.Paths[0].Path, b.Config.Paths[1].Path
+	err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, vimrc, []byte("set nu"), 0644)
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+	_, err = b.fs.Stat(filepath.Join(tmpDir, "pushed"))
+	Ok(t, err)
+
+	err = afero.WriteFile(b.fs, zshrc, []byte("v2"), 0644)
+	Ok(t, err)
+	committed, err := b.Commit()
+	Ok(t, err)
+	Equals(t, true, committed)
+	committed, err = b.Commit()
+	Ok(t, err)
+	Equals(t, false, committed)
+
+	commits, err := b.Log(zshrc)
+	Ok(t, err)
+	Equals(t, 2, len(commits))
+	// the edit and the manifest recording it.
+	Equals(t, "commit on "+b.hostname+", 2 files changed", commits[0].Subject)
+	Equals(t, "backup on "+b.hostname+", 3 files changed", commits[1].Subject)
+	commits, err = b.Log(vimrc)
+	Ok(t, err)
+	Equals(t, 1, len(commits))
+
+	// the journal and the other internal files are not committed.
+	files, err := b.git("ls-files")
+	Ok(t, err)
+	Equals(t, []string{"_HOME/.vimrc", "_HOME/.zshrc", "manifest.json"}, strings.Fields(files))
+}
@@ -0,0 +1,222 @@
+package backedup
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/spf13/afero"
+)
+
+// ignoreFilename holds gitignore style exclude rules for the directory it
+// is in and everything below it.
+const ignoreFilename = ".backedupignore"
+
+// ignoreRule is a single gitignore style pattern.
+type ignoreRule struct {
+	// dir is the slash separated directory the rule was read in, relative
+	// to the root of the matcher.
+	dir     string
+	pattern string
+	// negate re-includes paths matched by earlier rules.
+	negate bool
+	// dirOnly only matches directories.
+	dirOnly bool
+	// anchored patterns match relative to dir, others at any depth.
+	anchored bool
+}
+
+// ignoreMatcher matches paths relative to a backed up directory against
+// gitignore style rules. The last matching rule wins.
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// newIgnoreMatcher returns a matcher for the directory root. Absolute
+// patterns only apply if they are inside root.
+func newIgnoreMatcher(root string, patterns []string) *ignoreMatcher {
+	m := &ignoreMatcher{}
+	for _, pattern := range patterns {
+		if filepath.IsAbs(pattern) {
+			rel, err := filepath.Rel(root, pattern)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			pattern = "/" + filepath.ToSlash(rel)
+		}
+		if rule, ok := parseIgnoreLine("", pattern); ok {
+			m.rules = append(m.rules, rule)
+		}
+	}
+	return m
+}
+
+// parseIgnoreLine parses a line of a .backedupignore file read in dir.
+func parseIgnoreLine(dir, line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{dir: dir}
+	switch {
+	case strings.HasPrefix(line, "!"):
+		rule.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	rule.pattern = line
+	return rule, true
+}
+
+// withFile returns a matcher with the rules of the .backedupignore file in
+// dir added, rel is dir relative to the root of the matcher. m is returned
+// as is if there is no such file.
+func (m *ignoreMatcher) withFile(fs FS, dir, rel string) *ignoreMatcher {
+	data, err := afero.ReadFile(fs, filepath.Join(dir, ignoreFilename))
+	if err != nil {
+		return m
+	}
+	return m.withData(data, rel)
+}
+
+// withData returns a matcher with the rules of the content of a
+// .backedupignore file in rel added.
+func (m *ignoreMatcher) withData(data []byte, rel string) *ignoreMatcher {
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		rel = ""
+	}
+	rules := append([]ignoreRule{}, m.rules...)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreLine(rel, scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return &ignoreMatcher{rules: rules}
+}
+
+// empty reports whether the matcher has no rules.
+func (m *ignoreMatcher) empty() bool {
+	return len(m.rules) == 0
+}
+
+// match reports whether rel, relative to the root of the matcher, is
+// excluded.
+func (m *ignoreMatcher) match(rel string, isDir bool) bool {
+	rel = filepath.ToSlash(rel)
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		sub := rel
+		if rule.dir != "" {
+			if !strings.HasPrefix(rel, rule.dir+"/") {
+				continue
+			}
+			sub = strings.TrimPrefix(rel, rule.dir+"/")
+		}
+		pattern := rule.pattern
+		if !rule.anchored {
+			pattern = "**/" + pattern
+		}
+		if ok, _ := doublestar.Match(pattern, sub); ok {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// excluded reports whether the file rel or one of the directories it is in
+// is excluded, for listings that aren't walked like the keys of a Storage.
+func (m *ignoreMatcher) excluded(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if m.match(dir, true) {
+			return true
+		}
+	}
+	return m.match(rel, false)
+}
+
+// walkIgnore calls fn for every entry under root in lexical order, with
+// rel relative to root. Excluded entries are passed with ignored set and
+// not walked into. Symlinks are not followed.
+func walkIgnore(fs FS, root string, m *ignoreMatcher, fn func(rel string, info os.FileInfo, ignored bool) error) error {
+	return walkIgnoreDir(fs, root, "", m, fn)
+}
+
+// walkIgnoreDir walks the directory root/rel for walkIgnore.
+func walkIgnoreDir(fs FS, root, rel string, m *ignoreMatcher, fn func(rel string, info os.FileInfo, ignored bool) error) error {
+	dir := filepath.Join(root, rel)
+	m = m.withFile(fs, dir, rel)
+	fis, err := afero.ReadDir(fs, dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	for _, fi := range fis {
+		childRel := path.Join(filepath.ToSlash(rel), fi.Name())
+		ignored := m.match(childRel, fi.IsDir())
+		if err := fn(childRel, fi, ignored); err != nil {
+			return err
+		}
+		if fi.IsDir() && !ignored {
+			if err := walkIgnoreDir(fs, root, childRel, m, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasIgnored reports whether anything under root/rel is excluded, m
+// matches paths relative to root.
+func hasIgnored(fs FS, root, rel string, m *ignoreMatcher) (bool, error) {
+	found := false
+	err := walkIgnoreDir(fs, root, rel, m, func(rel string, info os.FileInfo, ignored bool) error {
+		if ignored {
+			found = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err == filepath.SkipDir {
+		err = nil
+	}
+	return found, err
+}
+
+// hasIgnoreFile reports whether there is a .backedupignore file under root.
+func hasIgnoreFile(fs FS, root string) (bool, error) {
+	found := false
+	err := walkIgnore(fs, root, &ignoreMatcher{}, func(rel string, info os.FileInfo, ignored bool) error {
+		if path.Base(rel) == ignoreFilename {
+			found = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err == filepath.SkipDir {
+		err = nil
+	}
+	return found, err
+}
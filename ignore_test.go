@@ -0,0 +1,113 @@
+package backedup
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	fs := NewMemFs()
+	err := afero.WriteFile(fs, "/app/cache/.backedupignore", []byte("# comment\n*.tmp\n!keep.tmp\n"), 0644)
+	Ok(t, err)
+	m := newIgnoreMatcher("/app", []string{"*.log", "build/", "/app/secret", "/other/file", "sub/*.json"})
+	tests := []struct {
+		rel     string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"deep/a.log", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"secret", false, true},
+		{"deep/secret", false, false},
+		{"sub/a.json", false, true},
+		{"deep/sub/a.json", false, false},
+		{"file", false, false},
+		{"cache/a.tmp", false, true},
+		{"cache/keep.tmp", false, false},
+		{"a.tmp", false, false},
+	}
+	m = m.withFile(fs, "/app/cache", "cache")
+	for _, tt := range tests {
+		Equals(t, tt.ignored, m.match(tt.rel, tt.isDir), tt.rel)
+	}
+}
+
+func TestBackupExclude(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+exclude:
+  - "*.log"
+paths:
+  - path: $HOME/.config/app
+    exclude:
+      - cache/`)
+	defer cleanup()
+	app := b.Config.Paths[0].Path
+	for _, path := range []string{"settings.json", "debug.log", "cache/data", "themes/dark.json", "plugins/.backedupignore", "plugins/a/state", "plugins/a/init.lua"} {
+		err := afero.WriteFile(b.fs, filepath.Join(app, path), []byte(path), 0644)
+		Ok(t, err)
+	}
+	err := afero.WriteFile(b.fs, filepath.Join(app, "plugins/.backedupignore"), []byte("state\n"), 0644)
+	Ok(t, err)
+
+	// children are linked one by one, excluded ones stay local.
+	err = b.Backup()
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, app)
+	checkNewSymlink(t, b.fs, filepath.Join(app, "settings.json"))
+	checkNewSymlink(t, b.fs, filepath.Join(app, "themes"))
+	checkNewSymlink(t, b.fs, filepath.Join(app, "plugins/.backedupignore"))
+	checkNewSymlink(t, b.fs, filepath.Join(app, "plugins/a/init.lua"))
+	checkNotSymlink(t, b.fs, filepath.Join(app, "debug.log"))
+	checkNotSymlink(t, b.fs, filepath.Join(app, "cache/data"))
+	checkNotSymlink(t, b.fs, filepath.Join(app, "plugins/a/state"))
+	exists, err := afero.Exists(b.fs, filepath.Join(b.backupPath(app), "debug.log"))
+	Ok(t, err)
+	Equals(t, false, exists)
+	statuses, err := b.Status()
+	Ok(t, err)
+	Equals(t, StateLinked, statuses[0].State)
+	plan, err := b.PlanBackup()
+	Ok(t, err)
+	Equals(t, Plan{}, plan)
+
+	// restore links the backed up children into a fresh directory, only
+	// directories with a .backedupignore file are split again.
+	err = b.fs.RemoveAll(app)
+	Ok(t, err)
+	err = b.Restore()
+	Ok(t, err)
+	checkNewSymlink(t, b.fs, filepath.Join(app, "settings.json"))
+	checkNewSymlink(t, b.fs, filepath.Join(app, "themes"))
+	checkNewSymlink(t, b.fs, filepath.Join(app, "plugins/.backedupignore"))
+	checkNewSymlink(t, b.fs, filepath.Join(app, "plugins/a"))
+	statuses, err = b.Status()
+	Ok(t, err)
+	Equals(t, StateLinked, statuses[0].State)
+
+	// uninstall copies the children back.
+	err = b.Uninstall()
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, filepath.Join(app, "settings.json"))
+	checkNotSymlink(t, b.fs, filepath.Join(app, "themes/dark.json"))
+	checkNotSymlink(t, b.fs, filepath.Join(app, "plugins/a/init.lua"))
+}
+
+func TestDirCopyIgnore(t *testing.T) {
+	fs := NewMemFs()
+	for _, path := range []string{"/src/a", "/src/b.tmp", "/src/sub/c.tmp"} {
+		err := afero.WriteFile(fs, path, []byte(path), 0644)
+		Ok(t, err)
+	}
+	err := afero.WriteFile(fs, "/src/.backedupignore", []byte("*.tmp\n"), 0644)
+	Ok(t, err)
+	err = DirCopyFS(fs, "/src", "/dst")
+	Ok(t, err)
+	files, err := listFiles(fs, "/dst", &ignoreMatcher{})
+	Ok(t, err)
+	Equals(t, map[string]bool{".backedupignore": true, "a": true}, files)
+}
@@ -0,0 +1,302 @@
+package backedup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	journalFilename = ".backedup-journal.json"
+)
+
+// StepState is the progress of a journaled action.
+type StepState string
+
+const (
+	// StepPending has not been started.
+	StepPending StepState = "pending"
+	// StepStarted was started but not recorded as done, it may or may not
+	// have taken effect.
+	StepStarted StepState = "started"
+	// StepDone has completed.
+	StepDone StepState = "done"
+	// StepRolledBack was completed and then undone.
+	StepRolledBack StepState = "rolled-back"
+)
+
+// RecoverMode selects how Recover handles an interrupted journal.
+type RecoverMode string
+
+const (
+	// RecoverFinish runs the remaining steps of an interrupted journal.
+	RecoverFinish RecoverMode = "finish"
+	// RecoverRollback undoes the completed steps of an interrupted journal.
+	RecoverRollback RecoverMode = "rollback"
+)
+
+// JournalStep is a single action recorded in the journal.
+type JournalStep struct {
+	Action Action    `json:"action"`
+	State  StepState `json:"state"`
+}
+
+// Journal records the steps of an Apply in the backup directory before
+// they run, so an interrupted run can be finished or undone.
+type Journal struct {
+	Started time.Time     `json:"started"`
+	Steps   []JournalStep `json:"steps"`
+}
+
+// journalPath returns the path of the journal file.
+func (b *Backedup) journalPath() string {
+	return filepath.Join(b.Config.BackupTo, journalFilename)
+}
+
+// readJournal loads the journal, it returns nil if there is none.
+func (b *Backedup) readJournal() (*Journal, error) {
+	data, err := afero.ReadFile(b.fs, b.journalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("%s %s", b.journalPath(), err)
+	}
+	return j, nil
+}
+
+// writeJournal saves the journal, replacing the previous one atomically.
+func (b *Backedup) writeJournal(j *Journal) error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := b.journalPath() + ".tmp"
+	if err := afero.WriteFile(b.fs, tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return b.fs.Rename(tmpPath, b.journalPath())
+}
+
+// runJournal runs every pending step, rolling back the completed steps of
+// a path when one of its steps fails. Failed paths are added to errs. A
+// prompt is recorded as the action it was answered with, the other steps
+// of a path skipped at a prompt don't run.
+func (b *Backedup) runJournal(j *Journal, errs *MultiError) error {
+	// the paths that failed or were skipped.
+	stopped := map[string]bool{}
+	for i := range j.Steps {
+		step := &j.Steps[i]
+		if step.Action.Type == ActionSkip {
+			stopped[step.Action.Path] = true
+		}
+		if step.State != StepPending || stopped[step.Action.Path] {
+			continue
+		}
+		var err error
+		if step.Action.Type == ActionPrompt {
+			step.Action, err = b.resolvePrompt(step.Action)
+		}
+		if err == nil && step.Action.Type == ActionSkip {
+			stopped[step.Action.Path] = true
+			step.State = StepDone
+			if err := b.writeJournal(j); err != nil {
+				return err
+			}
+			continue
+		}
+		if err == nil {
+			step.State = StepStarted
+			if err := b.writeJournal(j); err != nil {
+				return err
+			}
+			err = b.apply(step.Action)
+		}
+		if err != nil {
+			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", step.Action.Path, err)))
+			stopped[step.Action.Path] = true
+			errs.add(step.Action.Type, step.Action.Path, err)
+			step.State = StepPending
+			if err := b.rollbackPath(j, step.Action.Path, errs); err != nil {
+				return err
+			}
+			continue
+		}
+		step.State = StepDone
+		if err := b.writeJournal(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackPath undoes the completed steps of path in reverse order. Steps
+// that can't be undone are added to errs and the others are still undone,
+// only a failure to write the journal is returned.
+func (b *Backedup) rollbackPath(j *Journal, path string, errs *MultiError) error {
+	for i := len(j.Steps) - 1; i >= 0; i-- {
+		step := &j.Steps[i]
+		if step.Action.Path != path || step.State != StepDone {
+			continue
+		}
+		if err := b.undo(step.Action); err != nil {
+			err = fmt.Errorf("rollback failed %s", err)
+			b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", path, err)))
+			errs.add(step.Action.Type, path, err)
+			continue
+		}
+		step.State = StepRolledBack
+		if err := b.writeJournal(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undo reverses a completed action.
+func (b *Backedup) undo(a Action) error {
+	switch a.Type {
+	case ActionMove:
+		return b.fs.Rename(a.Dst, a.Src)
+	case ActionSymlink:
+		return b.fs.Remove(a.Dst)
+	case ActionCopy:
+		if a.Replace {
+			return fmt.Errorf("%s was replaced", a.Dst)
+		}
+		return b.fs.RemoveAll(a.Dst)
+	case ActionEncrypt, ActionDecrypt:
+		if a.Replace {
+			return fmt.Errorf("%s was replaced", a.Dst)
+		}
+		return b.fs.Remove(a.Dst)
+	case ActionRender:
+		return b.fs.Remove(a.Dst)
+	case ActionRemove:
+		if a.Src == "" {
+			return fmt.Errorf("%s was removed", a.Dst)
+		}
+		return b.fs.Symlink(a.Src, a.Dst)
+	case ActionPut:
+		if a.Replace {
+			return fmt.Errorf("%s was replaced", a.Dst)
+		}
+		return b.storage.Delete(a.Dst)
+	case ActionGet:
+		if a.Replace {
+			return fmt.Errorf("%s was replaced", a.Dst)
+		}
+		return b.fs.Remove(a.Dst)
+	case ActionDelete:
+		return fmt.Errorf("%s was deleted", a.Dst)
+	}
+	return nil
+}
+
+// stepDone checks whether a started action took effect before the run was
+// interrupted.
+func (b *Backedup) stepDone(a Action) bool {
+	switch a.Type {
+	case ActionMove:
+		_, srcErr := b.fs.Lstat(a.Src)
+		_, dstErr := b.fs.Lstat(a.Dst)
+		return os.IsNotExist(srcErr) && dstErr == nil
+	case ActionSymlink:
+		target, err := b.fs.Readlink(a.Dst)
+		return err == nil && target == a.Src
+	case ActionCopy:
+		if a.Replace {
+			// the file is swapped in at once, it can always be redone.
+			return false
+		}
+		// a partial copy counts as done so that rollback removes it.
+		_, err := b.fs.Lstat(a.Dst)
+		return err == nil
+	case ActionRemove:
+		_, err := b.fs.Lstat(a.Dst)
+		return os.IsNotExist(err)
+	case ActionChmod:
+		fi, err := b.fs.Stat(a.Dst)
+		return err == nil && fi.Mode().Perm() == a.Perm
+	case ActionPut:
+		// a put is swapped in at once by the storage.
+		_, err := b.storage.Stat(a.Dst)
+		return !a.Replace && err == nil
+	case ActionGet:
+		_, err := b.fs.Lstat(a.Dst)
+		return !a.Replace && err == nil
+	case ActionDelete:
+		_, err := b.storage.Stat(a.Dst)
+		return os.IsNotExist(err)
+	}
+	return false
+}
+
+// Recover finishes or rolls back a journal left behind by an interrupted
+// run. It does nothing if there is no journal. Paths that fail to finish are
+// rolled back and returned as a *MultiError.
+func (b *Backedup) Recover(mode RecoverMode) error {
+	j, err := b.readJournal()
+	if err != nil || j == nil {
+		return err
+	}
+	for i := range j.Steps {
+		step := &j.Steps[i]
+		if step.State != StepStarted {
+			continue
+		}
+		step.State = StepPending
+		if mode == RecoverFinish && (step.Action.Type == ActionCopy || step.Action.Type == ActionGet) && !step.Action.Replace {
+			// a copy may have been partial, start it over.
+			if err := b.fs.RemoveAll(step.Action.Dst); err != nil {
+				return err
+			}
+			continue
+		}
+		if b.stepDone(step.Action) {
+			step.State = StepDone
+		}
+	}
+	errs := &MultiError{Op: "recover", Total: countPaths(j.Steps)}
+	switch mode {
+	case RecoverFinish:
+		if err := b.runJournal(j, errs); err != nil {
+			return err
+		}
+	case RecoverRollback:
+		done := map[string]bool{}
+		for i := len(j.Steps) - 1; i >= 0; i-- {
+			path := j.Steps[i].Action.Path
+			if done[path] {
+				continue
+			}
+			done[path] = true
+			if err := b.rollbackPath(j, path, errs); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown recover mode %q", mode)
+	}
+	if err := b.fs.Remove(b.journalPath()); err != nil {
+		return err
+	}
+	return errs.errOrNil()
+}
+
+// countPaths returns the number of distinct paths of the steps.
+func countPaths(steps []JournalStep) int {
+	paths := map[string]bool{}
+	for _, step := range steps {
+		paths[step.Action.Path] = true
+	}
+	return len(paths)
+}
@@ -0,0 +1,131 @@
+package backedup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestApplyRollback(t *testing.T) {
+	b, tmpDir, cleanup := newTestBackedup(t, NewOsFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.gitconfig`)
+	defer cleanup()
+	path := b.Config.Paths[0].Path
+	err := afero.WriteFile(b.fs, path, []byte("[user]"), 0644)
+	Ok(t, err)
+
+	// the symlink can't be created because its parent is a regular file.
+	blocker := filepath.Join(tmpDir, "blocker")
+	err = afero.WriteFile(b.fs, blocker, []byte("blocker"), 0644)
+	Ok(t, err)
+	backupPath := b.backupPath(path)
+	badLink := filepath.Join(blocker, "child")
+	plan := Plan{
+		{Type: ActionMove, Path: path, Src: path, Dst: backupPath},
+		{Type: ActionSymlink, Path: path, Src: backupPath, Dst: badLink},
+	}
+	err = b.Apply(plan)
+	checkFailedPaths(t, err, path)
+
+	// the move is rolled back and the journal removed.
+	data, err := afero.ReadFile(b.fs, path)
+	Ok(t, err)
+	Equals(t, "[user]", string(data))
+	exists, err := afero.Exists(b.fs, backupPath)
+	Ok(t, err)
+	Equals(t, false, exists)
+	exists, err = afero.Exists(b.fs, filepath.Join(tmpDir, "backedup", journalFilename))
+	Ok(t, err)
+	Equals(t, false, exists)
+}
+
+// interruptBackup simulates a Backup of the configured path that stopped
+// after the move.
+func interruptBackup(t *testing.T, b *Backedup) (string, string) {
+	path := b.Config.Paths[0].Path
+	err := afero.WriteFile(b.fs, path, []byte("[user]"), 0644)
+	Ok(t, err)
+	plan, err := b.PlanBackup()
+	Ok(t, err)
+	backupPath := b.backupPath(path)
+	err = b.fs.MkdirAll(filepath.Dir(backupPath), 0755)
+	Ok(t, err)
+	err = b.fs.Rename(path, backupPath)
+	Ok(t, err)
+	err = b.writeJournal(&Journal{Steps: []JournalStep{
+		{Action: plan[0], State: StepStarted},
+		{Action: plan[1], State: StepPending},
+	}})
+	Ok(t, err)
+	Equals(t, ErrJournalExists, b.Backup())
+	return path, backupPath
+}
+
+func TestRecoverFinish(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.gitconfig`)
+	defer cleanup()
+	path, backupPath := interruptBackup(t, b)
+
+	err := b.Recover(RecoverFinish)
+	Ok(t, err)
+	target, err := b.fs.Readlink(path)
+	Ok(t, err)
+	Equals(t, backupPath, target)
+	j, err := b.readJournal()
+	Ok(t, err)
+	Equals(t, (*Journal)(nil), j)
+}
+
+func TestRecoverRollback(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.gitconfig`)
+	defer cleanup()
+	path, backupPath := interruptBackup(t, b)
+
+	err := b.Recover(RecoverRollback)
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, path)
+	exists, err := afero.Exists(b.fs, backupPath)
+	Ok(t, err)
+	Equals(t, false, exists)
+	j, err := b.readJournal()
+	Ok(t, err)
+	Equals(t, (*Journal)(nil), j)
+}
+
+func TestRecoverRollbackIrreversible(t *testing.T) {
+	b, tmpDir, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.gitconfig`)
+	defer cleanup()
+	removed, linked := filepath.Join(tmpDir, "removed"), filepath.Join(tmpDir, "linked")
+	err := b.fs.MkdirAll(b.Config.BackupTo, 0755)
+	Ok(t, err)
+	err = b.fs.Symlink("/elsewhere", linked)
+	Ok(t, err)
+	// the removal of a file can't be undone, the symlink of the path after
+	// it still is.
+	err = b.writeJournal(&Journal{Steps: []JournalStep{
+		{Action: Action{Type: ActionRemove, Path: removed, Dst: removed}, State: StepDone},
+		{Action: Action{Type: ActionSymlink, Path: linked, Src: "/elsewhere", Dst: linked}, State: StepDone},
+	}})
+	Ok(t, err)
+
+	err = b.Recover(RecoverRollback)
+	checkFailedPaths(t, err, removed)
+	_, err = b.fs.Lstat(linked)
+	Equals(t, true, os.IsNotExist(err))
+	j, err := b.readJournal()
+	Ok(t, err)
+	Equals(t, (*Journal)(nil), j)
+}
@@ -0,0 +1,217 @@
+package backedup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// manifestKey is the key of the manifest in the storage.
+const manifestKey = "manifest.json"
+
+// Manifest records every file in the backup so damage done to it outside
+// of backedup, like a partial sync of the directory, can be found.
+type Manifest struct {
+	// Files are the entries by key.
+	Files map[string]ManifestEntry `json:"files"`
+}
+
+// ManifestEntry is a file of the manifest.
+type ManifestEntry struct {
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	// SHA256 is the hex encoded hash of the content, empty for symlinks.
+	SHA256 string `json:"sha256,omitempty"`
+	// Target is set for symlinks.
+	Target string `json:"target,omitempty"`
+}
+
+// VerifyState describes how a file of the backup differs from the manifest.
+type VerifyState string
+
+const (
+	// VerifyMissing is in the manifest but not in the backup.
+	VerifyMissing VerifyState = "missing"
+	// VerifyModified has another size, mode, content or target than in the
+	// manifest.
+	VerifyModified VerifyState = "modified"
+	// VerifyEdited has other content and a newer mtime than in the
+	// manifest, like a file edited through its symlink since the last run.
+	// A file that became empty is VerifyModified.
+	VerifyEdited VerifyState = "edited"
+	// VerifyExtra is in the backup but not in the manifest.
+	VerifyExtra VerifyState = "extra"
+	// VerifyUnreadable can't be read to hash it.
+	VerifyUnreadable VerifyState = "unreadable"
+)
+
+// VerifyProblem is a file of the backup that doesn't match the manifest.
+type VerifyProblem struct {
+	Key   string
+	State VerifyState
+	// Detail says what differs or why it can't be read.
+	Detail string
+}
+
+func (p VerifyProblem) String() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%s %s", p.State, p.Key)
+	}
+	return fmt.Sprintf("%s %s: %s", p.State, p.Key, p.Detail)
+}
+
+// inManifest reports whether key is a file of the backup the manifest
+// covers, leaving out the ones backedup and the git backend keep.
+func inManifest(key string) bool {
+	return !internalKey(key) && key != manifestKey
+}
+
+// manifestObjects returns the files the manifest covers.
+func (b *Backedup) manifestObjects() ([]ObjectInfo, error) {
+	objects, err := b.storage.List("")
+	if err != nil {
+		return nil, err
+	}
+	files := []ObjectInfo{}
+	for _, o := range objects {
+		if !o.Mode.IsDir() && inManifest(o.Key) {
+			files = append(files, o)
+		}
+	}
+	return files, nil
+}
+
+// readManifest loads the manifest, it is empty if there is none.
+func (b *Backedup) readManifest() (*Manifest, error) {
+	m := &Manifest{Files: map[string]ManifestEntry{}}
+	data, err := b.readObject(manifestKey)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s %s", manifestKey, err)
+	}
+	if m.Files == nil {
+		m.Files = map[string]ManifestEntry{}
+	}
+	return m, nil
+}
+
+// writeManifest records the files of the backup in the manifest. Files
+// with the size, mode and mtime they had in the last manifest keep their
+// hash instead of being read again.
+func (b *Backedup) writeManifest() error {
+	if err := b.checkStorage(); err != nil {
+		// nothing was backed up, there is nothing to record.
+		return nil
+	}
+	prev, err := b.readManifest()
+	if err != nil {
+		return err
+	}
+	objects, err := b.manifestObjects()
+	if err != nil {
+		return err
+	}
+	m := &Manifest{Files: map[string]ManifestEntry{}}
+	for _, o := range objects {
+		e := ManifestEntry{Size: o.Size, Mode: o.Mode, ModTime: o.ModTime.UTC(), Target: o.Target}
+		if o.Target == "" {
+			p, ok := prev.Files[o.Key]
+			if ok && p.SHA256 != "" && p.Size == e.Size && p.Mode == e.Mode && p.ModTime.Equal(e.ModTime) {
+				e.SHA256 = p.SHA256
+			} else {
+				if o.ETag != "" {
+					b.etagCache().current[o.Key] = o.ETag
+				}
+				if e.SHA256, err = b.objectHash(o.Key, true); err != nil {
+					return fmt.Errorf("manifest %s %s", o.Key, err)
+				}
+			}
+		}
+		m.Files[o.Key] = e
+	}
+	if err := b.writeETagCache(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.storage.Put(ObjectInfo{Key: manifestKey, Size: int64(len(data)), Mode: 0644}, bytes.NewReader(data))
+}
+
+// Verify reads every file of the backup again and compares it with the
+// manifest written by the last run that changed the backup. A file whose
+// content changed together with a newer mtime is VerifyEdited, other
+// changes are VerifyModified.
+func (b *Backedup) Verify() ([]VerifyProblem, error) {
+	if err := b.checkStorage(); err != nil {
+		return nil, err
+	}
+	if _, err := b.storage.Stat(manifestKey); os.IsNotExist(err) {
+		return nil, ErrNoManifest
+	}
+	m, err := b.readManifest()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := b.manifestObjects()
+	if err != nil {
+		return nil, err
+	}
+	problems := []VerifyProblem{}
+	seen := map[string]bool{}
+	for _, o := range objects {
+		seen[o.Key] = true
+		e, ok := m.Files[o.Key]
+		if !ok {
+			problems = append(problems, VerifyProblem{Key: o.Key, State: VerifyExtra})
+			continue
+		}
+		if e.Target != "" || o.Target != "" {
+			if e.Target != o.Target {
+				problems = append(problems, VerifyProblem{Key: o.Key, State: VerifyModified, Detail: fmt.Sprintf("target %s, was %s", o.Target, e.Target)})
+			}
+			continue
+		}
+		hash, err := b.rehash(o.Key)
+		switch {
+		case err != nil:
+			problems = append(problems, VerifyProblem{Key: o.Key, State: VerifyUnreadable, Detail: err.Error()})
+		case (o.Size != e.Size || hash != e.SHA256) && o.ModTime.After(e.ModTime) && (o.Size > 0 || e.Size == 0):
+			problems = append(problems, VerifyProblem{Key: o.Key, State: VerifyEdited, Detail: fmt.Sprintf("mtime %s, was %s", o.ModTime.UTC().Format(time.RFC3339), e.ModTime.Format(time.RFC3339))})
+		case o.Size != e.Size:
+			problems = append(problems, VerifyProblem{Key: o.Key, State: VerifyModified, Detail: fmt.Sprintf("size %d, was %d", o.Size, e.Size)})
+		case hash != e.SHA256:
+			problems = append(problems, VerifyProblem{Key: o.Key, State: VerifyModified, Detail: "content changed"})
+		case o.Mode != e.Mode:
+			problems = append(problems, VerifyProblem{Key: o.Key, State: VerifyModified, Detail: fmt.Sprintf("mode %s, was %s", o.Mode, e.Mode)})
+		}
+	}
+	for key := range m.Files {
+		if !seen[key] {
+			problems = append(problems, VerifyProblem{Key: key, State: VerifyMissing})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Key < problems[j].Key })
+	return problems, nil
+}
+
+// rehash returns the hash of the content of key, read from the storage
+// even if its ETag is known.
+func (b *Backedup) rehash(key string) (string, error) {
+	rc, err := b.storage.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	return readerHash(rc)
+}
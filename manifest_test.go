@@ -0,0 +1,168 @@
+package backedup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestVerify(t *testing.T) {
+	b, tmpDir, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.zshrc
+  - $HOME/.vimrc
+  - $HOME/.config/app`)
+	defer cleanup()
+	zshrc, vimrc, app := b.Config.Paths[0].Path, b.Config.Paths[1].Path, b.Config.Paths[2].Path
+	err := b.fs.MkdirAll(b.Config.BackupTo, 0755)
+	Ok(t, err)
+	_, err = b.Verify()
+	Equals(t, ErrNoManifest, err)
+	err = afero.WriteFile(b.fs, zshrc, []byte("v1"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, vimrc, []byte("set nu"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(app, "settings.json"), []byte("{}"), 0644)
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+
+	m, err := b.readManifest()
+	Ok(t, err)
+	Equals(t, 3, len(m.Files))
+	e := m.Files["_HOME/.config/app/settings.json"]
+	Equals(t, int64(2), e.Size)
+	Equals(t, fileHashString("{}"), e.SHA256)
+	problems, err := b.Verify()
+	Ok(t, err)
+	Equals(t, []VerifyProblem{}, problems)
+
+	// the backup is changed behind backedup's back.
+	backup := filepath.Join(tmpDir, "backedup", backupHomeDirName)
+	err = afero.WriteFile(b.fs, filepath.Join(backup, ".zshrc"), []byte("v2"), 0644)
+	Ok(t, err)
+	mtime := m.Files["_HOME/.zshrc"].ModTime.Add(-time.Hour)
+	err = b.fs.Chtimes(filepath.Join(backup, ".zshrc"), mtime, mtime)
+	Ok(t, err)
+	err = b.fs.Remove(filepath.Join(backup, ".vimrc"))
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(backup, ".zshrc (conflicted copy)"), []byte("v0"), 0644)
+	Ok(t, err)
+	problems, err = b.Verify()
+	Ok(t, err)
+	Equals(t, []VerifyProblem{
+		{Key: "_HOME/.vimrc", State: VerifyMissing},
+		{Key: "_HOME/.zshrc", State: VerifyModified, Detail: "content changed"},
+		{Key: "_HOME/.zshrc (conflicted copy)", State: VerifyExtra},
+	}, problems)
+
+	// the next backup records the backup as it is.
+	err = b.Backup()
+	Ok(t, err)
+	problems, err = b.Verify()
+	Ok(t, err)
+	Equals(t, []VerifyProblem{}, problems)
+}
+
+func TestVerifyUnreadable(t *testing.T) {
+	s := newMapStorage()
+	RegisterStorage("map", func(c StorageConfig, fs FS, backupTo string) (Storage, error) {
+		return s, nil
+	})
+	defer delete(storageTypes, "map")
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+mode: copy
+storage:
+  type: map
+paths:
+  - $HOME/.zshrc`)
+	defer cleanup()
+	err := afero.WriteFile(b.fs, b.Config.Paths[0].Path, []byte("v1"), 0600)
+	Ok(t, err)
+	err = b.Sync()
+	Ok(t, err)
+	m, err := b.readManifest()
+	Ok(t, err)
+	Equals(t, fileHashString("v1"), m.Files["_HOME/.zshrc"].SHA256)
+
+	delete(s.data, "_HOME/.zshrc")
+	problems, err := b.Verify()
+	Ok(t, err)
+	Equals(t, 1, len(problems))
+	Equals(t, VerifyUnreadable, problems[0].State)
+	Equals(t, true, problems[0].Detail != "")
+}
+
+func TestVerifyAfterEdits(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.zshrc`)
+	defer cleanup()
+	zshrc := b.Config.Paths[0].Path
+	err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0644)
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+	first, err := b.Snapshot()
+	Ok(t, err)
+	m, err := b.readManifest()
+	Ok(t, err)
+	mtime := m.Files["_HOME/.zshrc"].ModTime
+
+	// an emptied file is damage even with a newer mtime.
+	err = afero.WriteFile(b.fs, zshrc, nil, 0644)
+	Ok(t, err)
+	err = b.fs.Chtimes(zshrc, mtime.Add(time.Hour), mtime.Add(time.Hour))
+	Ok(t, err)
+	problems, err := b.Verify()
+	Ok(t, err)
+	Equals(t, []VerifyProblem{{Key: "_HOME/.zshrc", State: VerifyModified, Detail: "size 0, was 2"}}, problems)
+
+	// an edit through the symlink is listed apart and recorded by the next absorb.
+	err = afero.WriteFile(b.fs, zshrc, []byte("v2 v2"), 0644)
+	Ok(t, err)
+	err = b.fs.Chtimes(zshrc, mtime.Add(time.Hour), mtime.Add(time.Hour))
+	Ok(t, err)
+	problems, err = b.Verify()
+	Ok(t, err)
+	Equals(t, []VerifyProblem{{
+		Key:    "_HOME/.zshrc",
+		State:  VerifyEdited,
+		Detail: fmt.Sprintf("mtime %s, was %s", mtime.Add(time.Hour).Format(time.RFC3339), mtime.Format(time.RFC3339)),
+	}}, problems)
+	var archive bytes.Buffer
+	err = b.Export(&archive, FormatTarGz)
+	Ok(t, err)
+	err = b.Absorb()
+	Ok(t, err)
+	problems, err = b.Verify()
+	Ok(t, err)
+	Equals(t, []VerifyProblem{}, problems)
+
+	// and by restoring a snapshot.
+	time.Sleep(2 * time.Millisecond)
+	err = b.RestoreSnapshot(first.ID)
+	Ok(t, err)
+	Equals(t, "v1", readString(t, b.fs, zshrc))
+	problems, err = b.Verify()
+	Ok(t, err)
+	Equals(t, []VerifyProblem{}, problems)
+
+	// an import doesn't keep the manifest of the archive.
+	fs := NewMemFs()
+	_, err = Import(fs, &archive, FormatTarGz, ioutil.Discard, b.ConfPath)
+	Ok(t, err)
+	imported, err := New(fs, &bytes.Buffer{}, ioutil.Discard, b.ConfPath)
+	Ok(t, err)
+	problems, err = imported.Verify()
+	Ok(t, err)
+	Equals(t, []VerifyProblem{}, problems)
+}
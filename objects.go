@@ -0,0 +1,295 @@
+package backedup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// objectsDirName is the directory in the backup directory with the
+	// object store.
+	objectsDirName = ".backedup-objects"
+	// incomingName is the blob being added before its hash is known.
+	incomingName = ".incoming"
+)
+
+// tree lists the files of a snapshot in the object store.
+type tree struct {
+	// Time is when the snapshot was taken.
+	Time time.Time `json:"time"`
+	// Entries are the files sorted by path.
+	Entries []treeEntry `json:"entries"`
+}
+
+// treeEntry is a file of a tree.
+type treeEntry struct {
+	// Path is relative to the backup directory with / separators.
+	Path string `json:"path"`
+	// Mode are the permissions of a regular file.
+	Mode os.FileMode `json:"mode,omitempty"`
+	// Size of a regular file.
+	Size int64 `json:"size,omitempty"`
+	// Blob is the sha256 of a regular file and names its blob.
+	Blob string `json:"blob,omitempty"`
+	// Target is set for symlinks.
+	Target string `json:"target,omitempty"`
+}
+
+// objectsDir returns the directory of the object store.
+func (b *Backedup) objectsDir() string {
+	return filepath.Join(b.Config.BackupTo, objectsDirName)
+}
+
+// blobsDir returns the directory with the blobs, they are spread over
+// directories named by the first two characters of the hash.
+func (b *Backedup) blobsDir() string {
+	return filepath.Join(b.objectsDir(), "blobs")
+}
+
+// blobPath returns the file of the blob hash.
+func (b *Backedup) blobPath(hash string) string {
+	return filepath.Join(b.blobsDir(), hash[:2], hash[2:])
+}
+
+// treePath returns the file of the tree of snapshot id.
+func (b *Backedup) treePath(id string) string {
+	return filepath.Join(b.objectsDir(), "trees", id+".json")
+}
+
+// treeSnapshots returns the snapshots in the object store.
+func (b *Backedup) treeSnapshots() ([]Snapshot, error) {
+	fis, err := afero.ReadDir(b.fs, filepath.Dir(b.treePath("")))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, fi := range fis {
+		id := strings.TrimSuffix(fi.Name(), ".json")
+		t, err := time.Parse(snapshotIDFormat, id)
+		if err != nil || id == fi.Name() || !fi.Mode().IsRegular() {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{ID: id, Time: t, Store: StoreObjects})
+	}
+	return snapshots, nil
+}
+
+// readTree returns the tree of snapshot id.
+func (b *Backedup) readTree(id string) (*tree, error) {
+	data, err := afero.ReadFile(b.fs, b.treePath(id))
+	if err != nil {
+		return nil, err
+	}
+	t := &tree{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("tree %s %s", id, err)
+	}
+	return t, nil
+}
+
+// putBlob adds the content of the file src to the store unless it is
+// there, and returns its hash. The content is copied before it is hashed so
+// a file changing meanwhile can't end up under the wrong name.
+func (b *Backedup) putBlob(src string) (string, error) {
+	if err := b.fs.MkdirAll(b.blobsDir(), 0755); err != nil {
+		return "", err
+	}
+	incoming := filepath.Join(b.blobsDir(), incomingName)
+	if err := FileCopyFS(b.fs, src, incoming); err != nil {
+		b.fs.Remove(incoming)
+		return "", err
+	}
+	defer b.fs.Remove(incoming)
+	hash, err := fileHash(b.fs, incoming)
+	if err != nil {
+		return "", err
+	}
+	blob := b.blobPath(hash)
+	if _, err := b.fs.Lstat(blob); err == nil {
+		return hash, nil
+	}
+	if err := b.fs.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return "", err
+	}
+	if err := b.fs.Chmod(incoming, 0444); err != nil {
+		return "", err
+	}
+	return hash, b.fs.Rename(incoming, blob)
+}
+
+// storeTree adds the files of the backup directory to the object store and
+// writes the tree of the snapshot. The snapshot only shows up once the tree
+// is written.
+func (b *Backedup) storeTree(s Snapshot) error {
+	files, err := listFiles(b.fs, b.Config.BackupTo, internalMatcher())
+	if err != nil {
+		return err
+	}
+	t := tree{Time: s.Time, Entries: []treeEntry{}}
+	for _, rel := range unionFiles(files, nil) {
+		path := filepath.Join(b.Config.BackupTo, rel)
+		fi, err := b.fs.Lstat(path)
+		if err != nil {
+			return err
+		}
+		e := treeEntry{Path: filepath.ToSlash(rel)}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if e.Target, err = b.fs.Readlink(path); err != nil {
+				return err
+			}
+		} else {
+			if e.Blob, err = b.putBlob(path); err != nil {
+				return err
+			}
+			e.Mode, e.Size = fi.Mode().Perm(), fi.Size()
+		}
+		t.Entries = append(t.Entries, e)
+	}
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := b.fs.MkdirAll(filepath.Dir(b.treePath(s.ID)), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(b.fs, b.treePath(s.ID), data, 0644)
+}
+
+// treeEntries returns the files of the tree of snapshot id.
+func (b *Backedup) treeEntries(id string) (map[string]snapshotEntry, error) {
+	t, err := b.readTree(id)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]snapshotEntry{}
+	for _, e := range t.Entries {
+		rel := filepath.FromSlash(e.Path)
+		if e.Target != "" {
+			entries[rel] = snapshotEntry{target: e.Target}
+			continue
+		}
+		if len(e.Blob) < 3 {
+			return nil, fmt.Errorf("tree %s %s has no blob", id, e.Path)
+		}
+		entries[rel] = snapshotEntry{src: b.blobPath(e.Blob), hash: e.Blob, perm: e.Mode}
+	}
+	return entries, nil
+}
+
+// blobs returns the hashes of the blobs in the store and their files.
+func (b *Backedup) blobs() (map[string]string, error) {
+	blobs := map[string]string{}
+	dirs, err := afero.ReadDir(b.fs, b.blobsDir())
+	if os.IsNotExist(err) {
+		return blobs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		fis, err := afero.ReadDir(b.fs, filepath.Join(b.blobsDir(), dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			blobs[dir.Name()+fi.Name()] = filepath.Join(b.blobsDir(), dir.Name(), fi.Name())
+		}
+	}
+	return blobs, nil
+}
+
+// GC removes the blobs no tree refers to and returns their number and
+// size.
+func (b *Backedup) GC() (int, int64, error) {
+	snapshots, err := b.treeSnapshots()
+	if err != nil {
+		return 0, 0, err
+	}
+	used := map[string]bool{}
+	for _, s := range snapshots {
+		t, err := b.readTree(s.ID)
+		if err != nil {
+			// a tree that can't be read might still need its blobs.
+			return 0, 0, err
+		}
+		for _, e := range t.Entries {
+			used[e.Blob] = true
+		}
+	}
+	blobs, err := b.blobs()
+	if err != nil {
+		return 0, 0, err
+	}
+	removed, size := 0, int64(0)
+	for hash, path := range blobs {
+		if used[hash] {
+			continue
+		}
+		fi, err := b.fs.Lstat(path)
+		if err != nil {
+			return removed, size, err
+		}
+		if err := b.fs.Remove(path); err != nil {
+			return removed, size, err
+		}
+		removed++
+		size += fi.Size()
+	}
+	return removed, size, nil
+}
+
+// Check verifies the hash of every blob and that the blobs of every tree
+// exist. It returns the problems found, the error is set if the store
+// couldn't be read.
+func (b *Backedup) Check() ([]error, error) {
+	problems := []error{}
+	blobs, err := b.blobs()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(blobs))
+	for hash := range blobs {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		got, err := fileHash(b.fs, blobs[hash])
+		if err != nil {
+			problems = append(problems, fmt.Errorf("blob %s %s", hash, err))
+			continue
+		}
+		if got != hash {
+			problems = append(problems, fmt.Errorf("blob %s has hash %s", hash, got))
+		}
+	}
+	snapshots, err := b.treeSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		t, err := b.readTree(s.ID)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		for _, e := range t.Entries {
+			if e.Target == "" && blobs[e.Blob] == "" {
+				problems = append(problems, fmt.Errorf("tree %s %s blob %s is missing", s.ID, e.Path, e.Blob))
+			}
+		}
+	}
+	return problems, nil
+}
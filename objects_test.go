@@ -0,0 +1,82 @@
+package backedup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestObjectStore(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+snapshot_store: objects
+paths:
+  - $HOME/.zshrc
+  - $HOME/.vim`)
+	defer cleanup()
+	zshrc := b.Config.Paths[0].Path
+	plugin := filepath.Join(b.Config.Paths[1].Path, "plugin.vim")
+	err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0600)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, plugin, []byte("plugin"), 0644)
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+
+	first, err := b.Snapshot()
+	Ok(t, err)
+	Equals(t, StoreObjects, first.Store)
+	time.Sleep(2 * time.Millisecond)
+	err = afero.WriteFile(b.fs, zshrc, []byte("bad"), 0644)
+	Ok(t, err)
+	second, err := b.Snapshot()
+	Ok(t, err)
+	snapshots, err := b.Snapshots()
+	Ok(t, err)
+	Equals(t, []Snapshot{first, second}, snapshots)
+	// the plugin and the manifest are stored once.
+	blobs, err := b.blobs()
+	Ok(t, err)
+	Equals(t, 4, len(blobs))
+
+	time.Sleep(2 * time.Millisecond)
+	err = b.RestoreSnapshot(first.ID)
+	Ok(t, err)
+	Equals(t, "v1", readString(t, b.fs, zshrc))
+	fi, err := b.fs.Stat(zshrc)
+	Ok(t, err)
+	Equals(t, "-rw-------", fi.Mode().Perm().String())
+	plan, err := b.PlanRestoreSnapshot(first.ID)
+	Ok(t, err)
+	Equals(t, Plan{}, plan)
+
+	problems, err := b.Check()
+	Ok(t, err)
+	Equals(t, []error{}, problems)
+
+	// only the safety snapshot of the restore is kept.
+	b.Config.Snapshots = Retention{Last: 1}
+	_, err = b.Prune()
+	Ok(t, err)
+	blobs, err = b.blobs()
+	Ok(t, err)
+	Equals(t, 3, len(blobs))
+
+	hash := fileHashString("bad")
+	err = afero.WriteFile(b.fs, b.blobPath(hash), []byte("corrupt"), 0444)
+	Ok(t, err)
+	problems, err = b.Check()
+	Ok(t, err)
+	Equals(t, 1, len(problems))
+	Equals(t, "blob "+hash+" has hash "+fileHashString("corrupt"), problems[0].Error())
+}
+
+// fileHashString returns the fileHash of a file with content s.
+func fileHashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,187 @@
+package backedup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/spf13/afero"
+)
+
+// excludePrefix marks an entry of Config.Paths as an exclusion.
+const excludePrefix = "!"
+
+// isPattern reports whether path contains glob characters.
+func isPattern(path string) bool {
+	return strings.ContainsAny(path, "*?[{")
+}
+
+// patternRoot returns the directory of pattern before the first element
+// with glob characters.
+func patternRoot(pattern string) string {
+	parts := strings.Split(pattern, string(filepath.Separator))
+	for i, part := range parts {
+		if isPattern(part) {
+			root := strings.Join(parts[:i], string(filepath.Separator))
+			if root == "" {
+				return string(filepath.Separator)
+			}
+			return root
+		}
+	}
+	return filepath.Dir(pattern)
+}
+
+// resolvePaths expands the glob patterns of Config.Paths, Config.Apps and
+// the paths included by the profile. It drops the paths matched by
+// exclusions or excluded by the profile and the ones not selected for this
+// host and Backedup.Tags. Patterns are matched against the local files if
+// local is set and against the backed up files if backup is set. Plain
+// paths are returned as they are, whether they exist or not. Every match
+// gets the options of the pattern that matched it.
+func (b *Backedup) resolvePaths(local, backup bool) ([]PathConfig, error) {
+	include, excludes := b.profilePaths()
+	configPaths := append(append(append([]PathConfig{}, b.Config.Paths...), b.appPaths...), include...)
+	for _, p := range configPaths {
+		if strings.HasPrefix(p.Path, excludePrefix) {
+			excludes = append(excludes, strings.TrimPrefix(p.Path, excludePrefix))
+		}
+	}
+	paths := []PathConfig{}
+	seen := map[string]bool{}
+	add := func(p PathConfig, path string) error {
+		if seen[path] {
+			return nil
+		}
+		for _, exclude := range excludes {
+			match, err := doublestar.PathMatch(exclude, path)
+			if err != nil {
+				return err
+			}
+			if match {
+				return nil
+			}
+		}
+		seen[path] = true
+		p.Path = path
+		paths = append(paths, p)
+		return nil
+	}
+	for _, p := range configPaths {
+		if strings.HasPrefix(p.Path, excludePrefix) || !b.selected(p) {
+			continue
+		}
+		if !isPattern(p.Path) {
+			if err := add(p, p.Path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		matches := []string{}
+		if local {
+			m, err := b.glob(p.Path, patternRoot(p.Path), nil)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, m...)
+		}
+		if backup {
+			m, err := b.glob(p.Path, b.backupPath(patternRoot(p.Path)), b.livePath)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, m...)
+		}
+		for _, match := range matches {
+			if err := add(p, match); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return paths, nil
+}
+
+// selected reports whether a path applies to this host and has one of
+// Backedup.Tags.
+func (b *Backedup) selected(p PathConfig) bool {
+	if len(p.Hosts) > 0 && !contains(p.Hosts, b.hostname) {
+		return false
+	}
+	if len(b.Tags) == 0 {
+		return true
+	}
+	for _, tag := range p.Tags {
+		if contains(b.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether s is in list.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// glob walks root and returns the paths that match pattern, a directory
+// that matches is not walked into. If toLive is set every walked path is
+// mapped with it before matching. Symlinks are not followed, the backup
+// directory and the files backedup keeps in it are left out.
+func (b *Backedup) glob(pattern, root string, toLive func(string) string) ([]string, error) {
+	// without ** nothing deeper than the pattern can match.
+	maxDepth := -1
+	if !strings.Contains(pattern, "**") {
+		maxDepth = strings.Count(pattern, string(filepath.Separator))
+	}
+	internal := internalMatcher()
+	matches := []string{}
+	err := afero.Walk(b.fs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		skip := path == b.Config.BackupTo && path != root
+		if rel, err := filepath.Rel(b.Config.BackupTo, path); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			skip = skip || internal.match(filepath.ToSlash(rel), info.IsDir())
+		}
+		if skip {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if toLive != nil {
+			path = toLive(path)
+		}
+		match, err := doublestar.PathMatch(pattern, path)
+		if err != nil {
+			return err
+		}
+		if match {
+			matches = append(matches, path)
+		}
+		if info.IsDir() && (match || (maxDepth >= 0 && strings.Count(path, string(filepath.Separator)) >= maxDepth)) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// livePath returns the path that backupPath is the backup of, the reverse
+// of Backedup.backupPath.
+func (b *Backedup) livePath(backupPath string) string {
+	backupHomeDir := filepath.Join(b.Config.BackupTo, backupHomeDirName)
+	if backupPath == backupHomeDir || strings.HasPrefix(backupPath, backupHomeDir+string(filepath.Separator)) {
+		return b.homeDir + strings.TrimPrefix(backupPath, backupHomeDir)
+	}
+	return string(filepath.Separator) + strings.TrimLeft(strings.TrimPrefix(backupPath, b.Config.BackupTo), string(filepath.Separator))
+}
@@ -0,0 +1,81 @@
+package backedup
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestResolvePaths(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.gitconfig
+  - path: $HOME/.zsh*
+    conflict: overwrite
+  - $HOME/.config/*/config.toml
+  - $HOME/.m2/**/*.xml
+  - "!$HOME/.zsh_history"
+  - "!$HOME/.m2/**/toolchains.xml"`)
+	defer cleanup()
+	home := b.homeDir
+	for _, path := range []string{
+		".zshrc", ".zsh_history", ".zsh/plugin.zsh", ".zprofile",
+		".config/alacritty/config.toml", ".config/alacritty/themes/config.toml", ".config/starship.toml",
+		".m2/settings.xml", ".m2/toolchains.xml", ".m2/repository/pom.xml",
+	} {
+		err := afero.WriteFile(b.fs, filepath.Join(home, path), []byte(path), 0644)
+		Ok(t, err)
+	}
+
+	paths, err := b.resolvePaths(true, false)
+	Ok(t, err)
+	Equals(t, []PathConfig{
+		{Path: filepath.Join(home, ".gitconfig")},
+		{Path: filepath.Join(home, ".zsh"), Conflict: ConflictOverwrite},
+		{Path: filepath.Join(home, ".zshrc"), Conflict: ConflictOverwrite},
+		{Path: filepath.Join(home, ".config/alacritty/config.toml")},
+		{Path: filepath.Join(home, ".m2/repository/pom.xml")},
+		{Path: filepath.Join(home, ".m2/settings.xml")},
+	}, paths)
+
+	// after a backup the patterns match the backup tree for restore.
+	err = b.Backup()
+	checkFailedPaths(t, err, filepath.Join(home, ".gitconfig"))
+	for _, p := range paths[1:] {
+		err = b.fs.Remove(p.Path)
+		Ok(t, err)
+	}
+	restored, err := b.resolvePaths(false, true)
+	Ok(t, err)
+	Equals(t, paths, restored)
+	err = b.Restore()
+	checkFailedPaths(t, err, filepath.Join(home, ".gitconfig"))
+	for _, p := range paths[1:] {
+		checkNewSymlink(t, b.fs, p.Path)
+	}
+}
+
+func TestResolvePathsBackupToInside(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/home/backedup
+paths:
+  - $HOME/**/config.toml`)
+	defer cleanup()
+	config := filepath.Join(b.homeDir, ".config/alacritty/config.toml")
+	err := afero.WriteFile(b.fs, config, []byte("config"), 0644)
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+	_, err = b.Snapshot()
+	Ok(t, err)
+
+	// neither the backup nor its snapshots are matched again.
+	paths, err := b.resolvePaths(true, false)
+	Ok(t, err)
+	Equals(t, []PathConfig{{Path: config}}, paths)
+	paths, err = b.resolvePaths(false, true)
+	Ok(t, err)
+	Equals(t, []PathConfig{{Path: config}}, paths)
+}
@@ -0,0 +1,244 @@
+package backedup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ActionType is the kind of change an Action makes to the filesystem.
+type ActionType string
+
+const (
+	// ActionMove renames Src to Dst.
+	ActionMove ActionType = "move"
+	// ActionSymlink creates a symlink at Dst pointing to Src.
+	ActionSymlink ActionType = "symlink"
+	// ActionCopy copies the file or directory Src to Dst.
+	ActionCopy ActionType = "copy"
+	// ActionRemove removes Dst. If Dst is a symlink Src is its target.
+	ActionRemove ActionType = "remove"
+	// ActionRender renders the template Src into the file Dst.
+	ActionRender ActionType = "render"
+	// ActionEncrypt encrypts the file Src into Dst.
+	ActionEncrypt ActionType = "encrypt"
+	// ActionDecrypt decrypts the file Src into Dst.
+	ActionDecrypt ActionType = "decrypt"
+	// ActionChmod sets the permissions of Dst to Perm. Rolling back doesn't
+	// restore the previous ones.
+	ActionChmod ActionType = "chmod"
+	// ActionPut stores the file Src in the storage under the key Dst.
+	ActionPut ActionType = "put"
+	// ActionGet copies the key Src of the storage to the file Dst.
+	ActionGet ActionType = "get"
+	// ActionDelete deletes the key Dst from the storage.
+	ActionDelete ActionType = "delete"
+	// ActionSkip leaves Path untouched, see Reason.
+	ActionSkip ActionType = "skip"
+	// ActionPrompt asks on stdin what to do with the existing file Dst when
+	// it runs, and is recorded as the move or remove that was chosen. If
+	// Dst is a symlink Src is its target.
+	ActionPrompt ActionType = "prompt"
+)
+
+// Action is a single planned step of a Backup, Restore or Uninstall.
+type Action struct {
+	// Type is the kind of action.
+	Type ActionType `json:"type"`
+	// Path is the configured path the action belongs to.
+	Path string `json:"path"`
+	// Src is the source of a move or copy, or the target of a symlink.
+	Src string `json:"src,omitempty"`
+	// Dst is the destination of a move, copy or symlink, or the removed path.
+	Dst string `json:"dst,omitempty"`
+	// Reason explains why a path is skipped, or the direction of a sync copy.
+	Reason string `json:"reason,omitempty"`
+	// Replace is set when a copy, put, get or encrypt replaces an existing
+	// file at Dst. The file is swapped in atomically and can't be rolled back.
+	Replace bool `json:"replace,omitempty"`
+	// Perm is the mode set by a chmod.
+	Perm os.FileMode `json:"perm,omitempty"`
+	// Err is set when the path is skipped because of an error.
+	Err error `json:"-"`
+}
+
+// String formats the action as a single line.
+func (a Action) String() string {
+	switch a.Type {
+	case ActionSkip:
+		return fmt.Sprintf("%-8s %s (%s)", a.Type, a.Path, a.Reason)
+	case ActionCopy, ActionPut, ActionGet:
+		if a.Reason != "" {
+			return fmt.Sprintf("%-8s %s -> %s (%s)", a.Type, a.Src, a.Dst, a.Reason)
+		}
+		return fmt.Sprintf("%-8s %s -> %s", a.Type, a.Src, a.Dst)
+	case ActionRemove, ActionDelete, ActionPrompt:
+		return fmt.Sprintf("%-8s %s", a.Type, a.Dst)
+	case ActionChmod:
+		return fmt.Sprintf("%-8s %s %#o", a.Type, a.Dst, a.Perm)
+	case ActionSymlink:
+		return fmt.Sprintf("%-8s %s -> %s", a.Type, a.Dst, a.Src)
+	default:
+		return fmt.Sprintf("%-8s %s -> %s", a.Type, a.Src, a.Dst)
+	}
+}
+
+// Plan is the ordered list of actions for an operation.
+type Plan []Action
+
+// String formats the plan one action per line.
+func (p Plan) String() string {
+	var sb strings.Builder
+	for _, a := range p {
+		sb.WriteString(a.String())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// countPaths returns the number of distinct paths in the plan.
+func (p Plan) countPaths() int {
+	paths := map[string]bool{}
+	for _, a := range p {
+		paths[a.Path] = true
+	}
+	return len(paths)
+}
+
+// skip adds a skip action for path.
+func (p *Plan) skip(path, reason string) {
+	*p = append(*p, Action{Type: ActionSkip, Path: path, Reason: reason})
+}
+
+// fail adds a skip action for path caused by err.
+func (p *Plan) fail(path string, err error) {
+	*p = append(*p, Action{Type: ActionSkip, Path: path, Reason: err.Error(), Err: err})
+}
+
+// add appends an action of type t for path.
+func (p *Plan) add(t ActionType, path, src, dst string) {
+	*p = append(*p, Action{Type: t, Path: path, Src: src, Dst: dst})
+}
+
+// Apply runs the actions of a plan in order. Every step is recorded in a
+// journal in the backup directory before it runs. When an action fails the
+// completed actions of the same path are rolled back, the remaining ones
+// are skipped and the error is logged. If any path failed a *MultiError is
+// returned. If a previous run was interrupted ErrJournalExists is returned
+// and Recover has to be called first.
+func (b *Backedup) Apply(plan Plan) error {
+	j, err := b.readJournal()
+	if err != nil {
+		return err
+	}
+	if j != nil {
+		return ErrJournalExists
+	}
+	if err := b.fs.MkdirAll(b.Config.BackupTo, 0755); err != nil {
+		return err
+	}
+	errs := &MultiError{Total: plan.countPaths()}
+	j = &Journal{Started: time.Now()}
+	for _, a := range plan {
+		if a.Type == ActionSkip {
+			if a.Err != nil {
+				b.logger.Write([]byte(fmt.Sprintf("ERRO: %s %s\n", a.Path, a.Err)))
+				errs.add(a.Type, a.Path, a.Err)
+			}
+			continue
+		}
+		j.Steps = append(j.Steps, JournalStep{Action: a, State: StepPending})
+	}
+	if len(j.Steps) == 0 {
+		return errs.errOrNil()
+	}
+	if err := b.runJournal(j, errs); err != nil {
+		return err
+	}
+	if err := b.fs.Remove(b.journalPath()); err != nil {
+		return err
+	}
+	return errs.errOrNil()
+}
+
+// apply runs a single action.
+func (b *Backedup) apply(a Action) error {
+	switch a.Type {
+	case ActionMove:
+		if err := b.fs.MkdirAll(filepath.Dir(a.Dst), 0755); err != nil {
+			return err
+		}
+		return b.fs.Rename(a.Src, a.Dst)
+	case ActionSymlink:
+		if err := b.fs.MkdirAll(filepath.Dir(a.Dst), 0755); err != nil {
+			return err
+		}
+		return b.fs.Symlink(a.Src, a.Dst)
+	case ActionCopy:
+		if err := b.fs.MkdirAll(filepath.Dir(a.Dst), 0755); err != nil {
+			return err
+		}
+		if _, err := b.fs.Lstat(a.Src); err != nil {
+			return err
+		}
+		if a.Replace {
+			tmpPath := a.Dst + ".backedup-tmp"
+			if err := b.copyPath(a.Src, tmpPath); err != nil {
+				b.fs.Remove(tmpPath)
+				return err
+			}
+			return b.fs.Rename(tmpPath, a.Dst)
+		}
+		return b.copyPath(a.Src, a.Dst)
+	case ActionRemove:
+		if a.Src != "" {
+			return b.fs.Remove(a.Dst)
+		}
+		return b.fs.RemoveAll(a.Dst)
+	case ActionRender:
+		if err := b.fs.MkdirAll(filepath.Dir(a.Dst), 0755); err != nil {
+			return err
+		}
+		return b.renderTo(a.Src, a.Dst)
+	case ActionEncrypt:
+		if err := b.fs.MkdirAll(filepath.Dir(a.Dst), 0755); err != nil {
+			return err
+		}
+		return b.encryptFile(a.Src, a.Dst)
+	case ActionDecrypt:
+		if err := b.fs.MkdirAll(filepath.Dir(a.Dst), 0700); err != nil {
+			return err
+		}
+		return b.decryptFile(a.Src, a.Dst)
+	case ActionChmod:
+		return b.fs.Chmod(a.Dst, a.Perm)
+	case ActionPut:
+		return b.put(a.Src, a.Dst)
+	case ActionGet:
+		if err := b.fs.MkdirAll(filepath.Dir(a.Dst), 0755); err != nil {
+			return err
+		}
+		return b.get(a.Src, a.Dst, a.Replace)
+	case ActionDelete:
+		return b.storage.Delete(a.Dst)
+	}
+	return fmt.Errorf("unknown action %q", a.Type)
+}
+
+// resolvePrompt asks what to do with the existing file of a prompt action
+// and returns the action chosen, a skip if the file is left alone.
+func (b *Backedup) resolvePrompt(a Action) (Action, error) {
+	policy, err := b.promptConflict(a.Dst)
+	if err != nil {
+		return a, err
+	}
+	switch policy {
+	case ConflictBackup:
+		return Action{Type: ActionMove, Path: a.Path, Src: a.Dst, Dst: origPathOf(a.Dst)}, nil
+	case ConflictOverwrite:
+		return Action{Type: ActionRemove, Path: a.Path, Src: a.Src, Dst: a.Dst}, nil
+	}
+	return Action{Type: ActionSkip, Path: a.Path, Reason: "file exists"}, nil
+}
@@ -0,0 +1,85 @@
+package backedup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestPlanBackup(t *testing.T) {
+	var stdin bytes.Buffer
+	var logger bytes.Buffer
+	fs := NewOsFs()
+	tmpDir, err := afero.TempDir(fs, "", "")
+	Ok(t, err)
+	defer fs.RemoveAll(tmpDir)
+	home := filepath.Join(tmpDir, "home")
+	os.Setenv("HOME", home)
+
+	filehome := filepath.Join(home, ".m2", "settings.xml")
+	err = fs.MkdirAll(filepath.Dir(filehome), 0755)
+	Ok(t, err)
+	err = afero.WriteFile(fs, filehome, []byte("settings"), 0644)
+	Ok(t, err)
+	missing := filepath.Join(home, ".missing")
+	symlink := filepath.Join(home, ".symlink")
+	err = os.Symlink(tmpDir, symlink)
+	Ok(t, err)
+
+	backupTo := filepath.Join(tmpDir, "backedup")
+	confPath := filepath.Join(home, ".backedup.yaml")
+	cfg := fmt.Sprintf(`
+backup_to: %s
+paths:
+  - %s
+  - %s
+  - %s`, backupTo, filehome, missing, symlink)
+	err = afero.WriteFile(fs, confPath, []byte(cfg), 0644)
+	Ok(t, err)
+
+	b, err := New(fs, &stdin, &logger, confPath)
+	Ok(t, err)
+	plan, err := b.PlanBackup()
+	Ok(t, err)
+
+	backupPath := filepath.Join(backupTo, backupHomeDirName, ".m2", "settings.xml")
+	Equals(t, 4, len(plan))
+	Equals(t, Action{Type: ActionMove, Path: filehome, Src: filehome, Dst: backupPath}, plan[0])
+	Equals(t, Action{Type: ActionSymlink, Path: filehome, Src: backupPath, Dst: filehome}, plan[1])
+	Equals(t, ActionSkip, plan[2].Type)
+	Equals(t, true, os.IsNotExist(plan[2].Err))
+	Equals(t, ActionSkip, plan[3].Type)
+	Equals(t, ErrSymlinkExists, plan[3].Err)
+
+	// planning must not touch the filesystem
+	exists, err := afero.Exists(fs, backupTo)
+	Ok(t, err)
+	Equals(t, false, exists)
+	checkNotSymlink(t, fs, filehome)
+
+	err = b.Apply(plan)
+	checkFailedPaths(t, err, missing, symlink)
+	checkNewSymlink(t, fs, filehome)
+	exists, err = afero.Exists(fs, backupPath)
+	Ok(t, err)
+	Equals(t, true, exists)
+
+	// a second plan sees the path as already backed up
+	plan, err = b.PlanBackup()
+	Ok(t, err)
+	Equals(t, Action{Type: ActionSkip, Path: filehome, Reason: "already backed up"}, plan[0])
+}
+
+func TestPlanString(t *testing.T) {
+	plan := Plan{
+		{Type: ActionMove, Path: "/a", Src: "/a", Dst: "/b/a"},
+		{Type: ActionSymlink, Path: "/a", Src: "/b/a", Dst: "/a"},
+		{Type: ActionSkip, Path: "/c", Reason: "symlink exists"},
+	}
+	want := "move     /a -> /b/a\nsymlink  /a -> /b/a\nskip     /c (symlink exists)\n"
+	Equals(t, want, plan.String())
+}
@@ -0,0 +1,113 @@
+package backedup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ProfileEnv is the environment variable that selects a profile.
+const ProfileEnv = "BACKEDUP_PROFILE"
+
+// hostsDirName is the directory in the backup directory with host specific
+// variants of backed up paths.
+const hostsDirName = "hosts"
+
+// Profile changes the configured paths on some machines.
+type Profile struct {
+	// Hosts are the hostnames the profile is used on without selecting it
+	// explicitly.
+	Hosts []string `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	// Include are paths used next to Config.Paths, with the same options.
+	Include []PathConfig `json:"include,omitempty" yaml:"include,omitempty"`
+	// Exclude are glob patterns of paths that are not used.
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	// Vars override Config.Vars for templates.
+	Vars map[string]string `json:"vars,omitempty" yaml:"vars,omitempty"`
+}
+
+// selectProfile returns the name of the profile to use. name is the
+// explicitly selected one, ProfileEnv is used if it is empty and then the
+// profile named like the host or listing it in Hosts. A host listed by more
+// than one profile is an error. An empty name means no profile.
+func (c *Config) selectProfile(name, hostname string) (string, error) {
+	if name == "" {
+		name = os.Getenv(ProfileEnv)
+	}
+	if name != "" {
+		if _, ok := c.Profiles[name]; !ok {
+			return "", fmt.Errorf("unknown profile %q", name)
+		}
+		return name, nil
+	}
+	if _, ok := c.Profiles[hostname]; ok {
+		return hostname, nil
+	}
+	matches := []string{}
+	for name, profile := range c.Profiles {
+		if contains(profile.Hosts, hostname) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	switch len(matches) {
+	case 0:
+		return "", nil
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("host %s is listed by profiles %s, select one with -profile or $%s", hostname, strings.Join(matches, ", "), ProfileEnv)
+}
+
+// SetProfile selects the profile name, overriding the one selected by
+// ProfileEnv or the hostname.
+func (b *Backedup) SetProfile(name string) error {
+	name, err := b.Config.selectProfile(name, b.hostname)
+	if err != nil {
+		return err
+	}
+	b.profile = name
+	return nil
+}
+
+// Profile returns the name of the selected profile, empty if there is none.
+func (b *Backedup) Profile() string {
+	return b.profile
+}
+
+// profilePaths returns the included paths and exclude patterns of the
+// selected profile with $HOME expanded.
+func (b *Backedup) profilePaths() ([]PathConfig, []string) {
+	profile, ok := b.Config.Profiles[b.profile]
+	if !ok {
+		return nil, nil
+	}
+	include := make([]PathConfig, len(profile.Include))
+	for i, p := range profile.Include {
+		include[i] = p.expandEnv()
+	}
+	exclude := make([]string, len(profile.Exclude))
+	for i, pattern := range profile.Exclude {
+		exclude[i] = os.ExpandEnv(pattern)
+	}
+	return include, exclude
+}
+
+// hostPath returns where the variant of path for this host is kept, it
+// overrides the shared copy at backupPath on Restore.
+func (b *Backedup) hostPath(path string) string {
+	rel := strings.TrimPrefix(b.backupPath(path), b.Config.BackupTo)
+	return filepath.Join(b.Config.BackupTo, hostsDirName, b.hostname, rel)
+}
+
+// restorePath returns the host variant of path if there is one and the
+// shared backup path otherwise.
+func (b *Backedup) restorePath(path string) string {
+	hostPath := b.hostPath(path)
+	if _, err := b.fs.Lstat(hostPath); err == nil {
+		return hostPath
+	}
+	return b.backupPath(path)
+}
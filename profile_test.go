@@ -0,0 +1,98 @@
+package backedup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestProfiles(t *testing.T) {
+	hostname, err := os.Hostname()
+	Ok(t, err)
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), fmt.Sprintf(`
+backup_to: %%[1]s/backedup
+paths:
+  - $HOME/.gitconfig
+  - $HOME/.zshrc
+profiles:
+  ci:
+    exclude:
+      - $HOME/.zshrc
+  laptop:
+    hosts: [%s]
+    include:
+      - $HOME/.ssh`, hostname))
+	defer cleanup()
+	home := b.homeDir
+	Equals(t, "laptop", b.Profile())
+	paths, err := b.resolvePaths(true, false)
+	Ok(t, err)
+	Equals(t, 3, len(paths))
+	Equals(t, filepath.Join(home, ".ssh"), paths[2].Path)
+
+	err = b.SetProfile("ci")
+	Ok(t, err)
+	paths, err = b.resolvePaths(true, false)
+	Ok(t, err)
+	Equals(t, []PathConfig{{Path: filepath.Join(home, ".gitconfig")}}, paths)
+
+	os.Setenv(ProfileEnv, "nope")
+	defer os.Unsetenv(ProfileEnv)
+	err = b.SetProfile("")
+	Equals(t, `unknown profile "nope"`, fmt.Sprint(err))
+}
+
+func TestSelectProfileAmbiguous(t *testing.T) {
+	conf := &Config{Profiles: map[string]Profile{
+		"work":   {Hosts: []string{"box"}},
+		"laptop": {Hosts: []string{"box", "other"}},
+	}}
+	for i := 0; i < 10; i++ {
+		_, err := conf.selectProfile("", "box")
+		Equals(t, "host box is listed by profiles laptop, work, select one with -profile or $BACKEDUP_PROFILE", fmt.Sprint(err))
+	}
+	name, err := conf.selectProfile("", "other")
+	Ok(t, err)
+	Equals(t, "laptop", name)
+	name, err = conf.selectProfile("work", "box")
+	Ok(t, err)
+	Equals(t, "work", name)
+}
+
+func TestHostVariant(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.gitconfig`)
+	defer cleanup()
+	gitconfig := b.Config.Paths[0].Path
+	err := afero.WriteFile(b.fs, gitconfig, []byte("shared"), 0644)
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+	err = b.fs.Remove(gitconfig)
+	Ok(t, err)
+
+	// the variant of this host is linked instead of the shared copy.
+	hostPath := b.hostPath(gitconfig)
+	Equals(t, filepath.Join(b.Config.BackupTo, "hosts", b.hostname, "_HOME/.gitconfig"), hostPath)
+	err = afero.WriteFile(b.fs, hostPath, []byte("host"), 0644)
+	Ok(t, err)
+	err = b.Restore()
+	Ok(t, err)
+	Equals(t, "host", readString(t, b.fs, gitconfig))
+	statuses, err := b.Status()
+	Ok(t, err)
+	Equals(t, StateLinked, statuses[0].State)
+	plan, err := b.PlanBackup()
+	Ok(t, err)
+	Equals(t, ActionSkip, plan[0].Type)
+
+	err = b.Uninstall()
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, gitconfig)
+	Equals(t, "host", readString(t, b.fs, gitconfig))
+}
@@ -0,0 +1,387 @@
+package backedup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StorageS3 is the storage type of a bucket of an S3 compatible endpoint,
+// selected by a backup_to like s3://bucket/prefix.
+const StorageS3 = "s3"
+
+// s3Storage is a Storage in a bucket of an S3 compatible endpoint, the keys
+// are kept under a prefix. Modes, mtimes and symlink targets are kept as
+// object metadata.
+type s3Storage struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	pathStyle bool
+	keyID     string
+	secret    string
+	token     string
+}
+
+// openS3Storage opens the storage of a backup_to like s3://bucket/prefix.
+// The options are endpoint, https://s3.<region>.amazonaws.com if empty,
+// region, AWS_REGION or us-east-1 if empty, and path_style, "true" puts the
+// bucket in the path instead of the host name as MinIO and the like need.
+// The credentials are AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+func openS3Storage(c StorageConfig, fs FS, backupTo string) (Storage, error) {
+	u, err := url.Parse(backupTo)
+	if err != nil || u.Scheme != StorageS3 || u.Host == "" {
+		return nil, fmt.Errorf("backup_to %s is not s3://bucket/prefix", backupTo)
+	}
+	s := &s3Storage{
+		client: &http.Client{Timeout: 5 * time.Minute},
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		region: c.Options["region"],
+		keyID:  os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	endpoint := c.Options["endpoint"]
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", endpoint)
+	}
+	if ps := c.Options["path_style"]; ps != "" {
+		if s.pathStyle, err = strconv.ParseBool(ps); err != nil {
+			return nil, fmt.Errorf("invalid s3 path_style %q", ps)
+		}
+	}
+	if s.keyID == "" || s.secret == "" {
+		return nil, fmt.Errorf("s3 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+// fullKey returns the object key of key.
+func (s *s3Storage) fullKey(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return path.Join(s.prefix, key)
+}
+
+// url returns the URL of the object key, or of the bucket if key is empty.
+func (s *s3Storage) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		p += "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	p += "/" + key
+	u.Path, u.RawPath = p, awsEscape(p, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do sends a signed request for the object key and returns the response
+// if it is a success. A missing object is an error for which os.IsNotExist
+// is true.
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	sum := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+	req.Header.Set("Authorization", sigV4(req, s.keyID, s.secret, s.region, "s3"))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &e) != nil || e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3 %s %s %s %s", method, key, e.Code, e.Message)
+}
+
+// Put implements Storage. The content is read into memory first since the
+// signature covers its sha256, objects are dotfiles and small.
+func (s *s3Storage) Put(info ObjectInfo, r io.Reader) error {
+	if info.Mode.IsDir() {
+		return nil
+	}
+	var data []byte
+	if r != nil && info.Target == "" {
+		var err error
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	mtime := info.ModTime
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	header := http.Header{}
+	header.Set("X-Amz-Meta-Mode", strconv.FormatUint(uint64(info.Mode.Perm()), 8))
+	header.Set("X-Amz-Meta-Mtime", mtime.UTC().Format(time.RFC3339Nano))
+	if info.Target != "" {
+		header.Set("X-Amz-Meta-Target", url.PathEscape(info.Target))
+	}
+	resp, err := s.do(http.MethodPut, s.fullKey(info.Key), nil, header, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Get implements Storage.
+func (s *s3Storage) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.fullKey(key), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Stat implements Storage.
+func (s *s3Storage) Stat(key string) (ObjectInfo, error) {
+	resp, err := s.do(http.MethodHead, s.fullKey(key), nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	info := ObjectInfo{Key: key, Size: resp.ContentLength, Mode: 0644, ETag: resp.Header.Get("ETag")}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if mode, err := strconv.ParseUint(resp.Header.Get("X-Amz-Meta-Mode"), 8, 32); err == nil {
+		info.Mode = os.FileMode(mode).Perm()
+	}
+	if mtime, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Amz-Meta-Mtime")); err == nil {
+		info.ModTime = mtime
+	}
+	if target := resp.Header.Get("X-Amz-Meta-Target"); target != "" {
+		info.Target, _ = url.PathUnescape(target)
+		info.Mode |= os.ModeSymlink
+	}
+	return info, nil
+}
+
+// s3ListResult is the response of a ListObjectsV2.
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+		ETag         string
+	}
+}
+
+// List returns the keys from the listing of the bucket, which has no modes,
+// they are 0644. Stat returns the mode of a key.
+func (s *s3Storage) List(prefix string) ([]ObjectInfo, error) {
+	full := s.fullKey(prefix)
+	query := url.Values{"list-type": {"2"}}
+	if full != "" {
+		query.Set("prefix", full)
+	}
+	objects := []ObjectInfo{}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s %s", full, err)
+		}
+		for _, c := range result.Contents {
+			key := c.Key
+			if s.prefix != "" {
+				if !strings.HasPrefix(key, s.prefix+"/") {
+					continue
+				}
+				key = strings.TrimPrefix(key, s.prefix+"/")
+			}
+			// a prefix lists itself and what is below it, not the keys it
+			// is a prefix of.
+			if prefix != "" && key != prefix && !strings.HasPrefix(key, prefix+"/") {
+				continue
+			}
+			objects = append(objects, ObjectInfo{Key: key, Size: c.Size, Mode: 0644, ModTime: c.LastModified, ETag: c.ETag})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Delete implements Storage.
+func (s *s3Storage) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, s.fullKey(key), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Lock puts a lock object unless there is one. S3 has no atomic create, two
+// runs starting at the same moment can both get it.
+func (s *s3Storage) Lock() (func() error, error) {
+	if _, err := s.Stat(lockKey); err == nil {
+		return nil, fmt.Errorf("%w, delete %s if no other run is going on", ErrLocked, s.fullKey(lockKey))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s %d %s\n", hostname, os.Getpid(), time.Now().Format(time.RFC3339))
+	if err := s.Put(ObjectInfo{Key: lockKey, Mode: 0644}, strings.NewReader(owner)); err != nil {
+		return nil, err
+	}
+	return func() error { return s.Delete(lockKey) }, nil
+}
+
+// amzDateFormat is the format of X-Amz-Date.
+const amzDateFormat = "20060102T150405Z"
+
+// sigV4 returns the Authorization header of req signed with AWS Signature
+// Version 4. Every header of req is signed, X-Amz-Date and
+// X-Amz-Content-Sha256 have to be set.
+func sigV4(req *http.Request, keyID, secret, region, service string) string {
+	amzDate := req.Header.Get("X-Amz-Date")
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "authorization" {
+			continue
+		}
+		values := make([]string, len(v))
+		for i := range v {
+			values[i] = strings.Join(strings.Fields(v[i]), " ")
+		}
+		headers[k] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := strings.Join([]string{amzDate[:8], region, service, "aws4_request"}, "/")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(sum[:])}, "\n")
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", keyID, scope, signedHeaders, signature)
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns query sorted and escaped the way SigV4 signs it.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent encodes everything but unreserved characters, and
+// slashes unless encodeSlash is set.
+func awsEscape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
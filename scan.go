@@ -0,0 +1,185 @@
+package backedup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+
+	"github.com/spf13/afero"
+)
+
+// Finding is a possible secret in a file.
+type Finding struct {
+	// Path is the file the secret is in.
+	Path string `json:"path"`
+	// Line is the line number starting at 1.
+	Line int `json:"line"`
+	// Rule is the kind of secret.
+	Rule string `json:"rule"`
+	// Allowed is set if the configured path is encrypted or allows secrets.
+	Allowed bool `json:"allowed,omitempty"`
+}
+
+// String formats the finding as path:line: rule.
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: %s", f.Path, f.Line, f.Rule)
+}
+
+// secretRule matches a kind of secret on a single line.
+type secretRule struct {
+	name string
+	re   *regexp.Regexp
+	// files limits the rule to files with these names, all files if empty.
+	files []string
+}
+
+var secretRules = []secretRule{
+	{name: "private key", re: regexp.MustCompile(`-----BEGIN ([A-Z]+ )*PRIVATE KEY( BLOCK)?-----`)},
+	{name: "aws access key", re: regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{name: "aws secret key", re: regexp.MustCompile(`(?i)aws_secret_access_key\s*[=:]\s*\S{40}`)},
+	{name: "netrc password", re: regexp.MustCompile(`\bpassword\s+\S+`), files: []string{".netrc", "_netrc"}},
+	{name: "npm token", re: regexp.MustCompile(`_(authToken|auth|password)\s*=\s*\S+`), files: []string{".npmrc"}},
+}
+
+// tokenRe matches candidates for high entropy strings.
+var tokenRe = regexp.MustCompile(`[A-Za-z0-9+/_=-]{32,}`)
+
+// minEntropy in bits per character, random base64 is close to 6 while text
+// and hex strings stay below 4.
+const minEntropy = 4.5
+
+// entropy returns the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+	e := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(len(s))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// mixedCase reports whether s has upper and lower case letters and digits,
+// like generated tokens but unlike paths or words.
+func mixedCase(s string) bool {
+	var upper, lower, digit bool
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= '0' && r <= '9':
+			digit = true
+		}
+	}
+	return upper && lower && digit
+}
+
+// scanFile returns the possible secrets in a file, binary files are
+// skipped.
+func scanFile(fs FS, path string) ([]Finding, error) {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	head := data
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+	findings := []Finding{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		found := false
+		for _, rule := range secretRules {
+			if len(rule.files) > 0 && !contains(rule.files, filepath.Base(path)) {
+				continue
+			}
+			if rule.re.MatchString(line) {
+				findings = append(findings, Finding{Path: path, Line: n, Rule: rule.name})
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		for _, token := range tokenRe.FindAllString(line, -1) {
+			if mixedCase(token) && entropy(token) >= minEntropy {
+				findings = append(findings, Finding{Path: path, Line: n, Rule: "high entropy string"})
+				break
+			}
+		}
+	}
+	return findings, scanner.Err()
+}
+
+// scanPath returns the possible secrets in the files of a configured path
+// that aren't excluded.
+func (b *Backedup) scanPath(p PathConfig) ([]Finding, error) {
+	files, err := listFiles(b.fs, p.Path, b.excludes(p))
+	if err != nil {
+		return nil, err
+	}
+	findings := []Finding{}
+	for _, rel := range unionFiles(files, nil) {
+		path := filepath.Join(p.Path, rel)
+		if fi, err := b.fs.Stat(path); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		found, err := scanFile(b.fs, path)
+		if err != nil {
+			return nil, err
+		}
+		for i := range found {
+			found[i].Allowed = p.Encrypt || p.AllowSecrets
+		}
+		findings = append(findings, found...)
+	}
+	return findings, nil
+}
+
+// Scan returns the possible secrets in every configured path.
+func (b *Backedup) Scan() ([]Finding, error) {
+	paths, err := b.resolvePaths(true, false)
+	if err != nil {
+		return nil, err
+	}
+	findings := []Finding{}
+	for _, p := range paths {
+		found, err := b.scanPath(p)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, found...)
+	}
+	return findings, nil
+}
+
+// checkSecrets returns an error for the first possible secret in the files
+// of a path, unless the path allows secrets.
+func (b *Backedup) checkSecrets(p PathConfig) error {
+	if p.Encrypt || p.AllowSecrets {
+		return nil
+	}
+	findings, err := b.scanPath(p)
+	if err != nil {
+		return err
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+	f := findings[0]
+	return fmt.Errorf("%w, %s line %d (%s), set encrypt or allow_secrets", ErrSecretFound, f.Path, f.Line, f.Rule)
+}
@@ -0,0 +1,414 @@
+package backedup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// snapshotsDirName is the directory in the backup directory with the
+	// snapshots.
+	snapshotsDirName = ".backedup-snapshots"
+	// snapshotIDFormat is the time format of snapshot ids, in UTC.
+	snapshotIDFormat = "20060102T150405.000Z"
+)
+
+// Snapshot is a point in time copy of the backup directory.
+type Snapshot struct {
+	// ID names the snapshot, it is its time in UTC.
+	ID string `json:"id"`
+	// Time is when the snapshot was taken.
+	Time time.Time `json:"time"`
+	// Store is how the snapshot is kept.
+	Store SnapshotStore `json:"store"`
+}
+
+// Retention decides which snapshots are kept when a new one is taken. A
+// snapshot is kept if any of the rules keeps it, with no rules set every
+// snapshot is kept.
+type Retention struct {
+	// Last keeps the newest snapshots.
+	Last int `json:"keep_last,omitempty" yaml:"keep_last,omitempty"`
+	// Daily keeps the newest snapshot of each of the last days with
+	// snapshots.
+	Daily int `json:"keep_daily,omitempty" yaml:"keep_daily,omitempty"`
+	// Weekly keeps the newest snapshot of each of the last weeks with
+	// snapshots.
+	Weekly int `json:"keep_weekly,omitempty" yaml:"keep_weekly,omitempty"`
+}
+
+// empty reports whether no rule is set.
+func (r Retention) empty() bool {
+	return r.Last == 0 && r.Daily == 0 && r.Weekly == 0
+}
+
+// snapshotsDir returns the directory with the snapshots.
+func (b *Backedup) snapshotsDir() string {
+	return filepath.Join(b.Config.BackupTo, snapshotsDirName)
+}
+
+// internalMatcher excludes the files backedup keeps in the backup directory
+// for itself and the repository of the git backend.
+func internalMatcher() *ignoreMatcher {
+	return &ignoreMatcher{rules: []ignoreRule{{pattern: ".backedup-*", anchored: true}, {pattern: ".git", anchored: true}}}
+}
+
+// Snapshots returns the snapshots from oldest to newest.
+func (b *Backedup) Snapshots() ([]Snapshot, error) {
+	fis, err := afero.ReadDir(b.fs, b.snapshotsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, fi := range fis {
+		t, err := time.Parse(snapshotIDFormat, fi.Name())
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{ID: fi.Name(), Time: t, Store: StoreLinks})
+	}
+	trees, err := b.treeSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	snapshots = append(snapshots, trees...)
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// findSnapshot returns the snapshot id.
+func (b *Backedup) findSnapshot(id string) (Snapshot, error) {
+	snapshots, err := b.Snapshots()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, s := range snapshots {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return Snapshot{}, fmt.Errorf("unknown snapshot %q", id)
+}
+
+// snapshotStore returns the store of new snapshots.
+func (b *Backedup) snapshotStore() SnapshotStore {
+	if b.Config.SnapshotStore == "" {
+		return StoreLinks
+	}
+	return b.Config.SnapshotStore
+}
+
+// Snapshot copies the backup directory to a new snapshot and then removes
+// the snapshots Config.Snapshots doesn't keep. Files that didn't change
+// are stored once, as hard links to the previous snapshot or as the same
+// blob of the object store. The storage is locked meanwhile so no other
+// run changes the files being copied.
+func (b *Backedup) Snapshot() (Snapshot, error) {
+	unlock, err := b.storage.Lock()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snapshot, err := b.snapshot()
+	if err == nil {
+		_, err = b.Prune()
+	}
+	if uerr := unlock(); uerr != nil && err == nil {
+		err = uerr
+	}
+	return snapshot, err
+}
+
+// snapshot takes a snapshot without pruning, the caller holds the lock of
+// the storage.
+func (b *Backedup) snapshot() (Snapshot, error) {
+	if err := b.checkBackupTo(); err != nil {
+		return Snapshot{}, err
+	}
+	snapshots, err := b.Snapshots()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	snapshot := Snapshot{ID: now.Format(snapshotIDFormat), Time: now, Store: b.snapshotStore()}
+	prev := ""
+	for _, s := range snapshots {
+		if s.ID == snapshot.ID {
+			return Snapshot{}, fmt.Errorf("snapshot %s exists", snapshot.ID)
+		}
+		if s.Store == StoreLinks {
+			prev = filepath.Join(b.snapshotsDir(), s.ID)
+		}
+	}
+	if snapshot.Store == StoreObjects {
+		return snapshot, b.storeTree(snapshot)
+	}
+	dir := filepath.Join(b.snapshotsDir(), snapshot.ID)
+	// the snapshot only shows up once it is complete.
+	tmpDir := dir + ".tmp"
+	if err := b.fs.RemoveAll(tmpDir); err != nil {
+		return Snapshot{}, err
+	}
+	files, err := listFiles(b.fs, b.Config.BackupTo, internalMatcher())
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, rel := range unionFiles(files, nil) {
+		if err := b.snapshotFile(filepath.Join(b.Config.BackupTo, rel), filepath.Join(tmpDir, rel), prev, rel); err != nil {
+			b.fs.RemoveAll(tmpDir)
+			return Snapshot{}, err
+		}
+	}
+	if err := b.fs.MkdirAll(tmpDir, 0755); err != nil {
+		return Snapshot{}, err
+	}
+	if err := b.fs.Rename(tmpDir, dir); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// snapshotFile copies src to dst, or links it to the same file of the
+// previous snapshot if it didn't change.
+func (b *Backedup) snapshotFile(src, dst, prev, rel string) error {
+	if err := b.fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	fi, err := b.fs.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := b.fs.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return b.fs.Symlink(target, dst)
+	}
+	if prev != "" {
+		prevFile := filepath.Join(prev, rel)
+		if same, _ := sameFile(b.fs, src, prevFile); same && b.fs.Link(prevFile, dst) == nil {
+			return nil
+		}
+	}
+	return FileCopyFS(b.fs, src, dst)
+}
+
+// sameFile reports whether two regular files have the same permissions and
+// content.
+func sameFile(fs FS, a, b string) (bool, error) {
+	afi, err := fs.Lstat(a)
+	if err != nil {
+		return false, err
+	}
+	bfi, err := fs.Lstat(b)
+	if err != nil {
+		return false, err
+	}
+	if !afi.Mode().IsRegular() || !bfi.Mode().IsRegular() || afi.Mode().Perm() != bfi.Mode().Perm() || afi.Size() != bfi.Size() {
+		return false, nil
+	}
+	ah, err := fileHash(fs, a)
+	if err != nil {
+		return false, err
+	}
+	bh, err := fileHash(fs, b)
+	if err != nil {
+		return false, err
+	}
+	return ah == bh, nil
+}
+
+// Prune removes the snapshots Config.Snapshots doesn't keep and returns
+// them.
+func (b *Backedup) Prune() ([]Snapshot, error) {
+	retention := b.Config.Snapshots
+	if retention.empty() {
+		return nil, nil
+	}
+	snapshots, err := b.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	keep := map[string]bool{}
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		if len(snapshots)-i <= retention.Last {
+			keep[s.ID] = true
+		}
+		local := s.Time.Local()
+		day := local.Format("2006-01-02")
+		if !days[day] && len(days) < retention.Daily {
+			days[day] = true
+			keep[s.ID] = true
+		}
+		year, week := local.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+		if !weeks[weekKey] && len(weeks) < retention.Weekly {
+			weeks[weekKey] = true
+			keep[s.ID] = true
+		}
+	}
+	removed := []Snapshot{}
+	objects := false
+	for _, s := range snapshots {
+		if keep[s.ID] {
+			continue
+		}
+		if s.Store == StoreObjects {
+			err = b.fs.Remove(b.treePath(s.ID))
+			objects = true
+		} else {
+			err = b.fs.RemoveAll(filepath.Join(b.snapshotsDir(), s.ID))
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, s)
+	}
+	if objects {
+		// the blobs only the removed trees used.
+		if _, _, err := b.GC(); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// snapshotEntry is a file of a snapshot.
+type snapshotEntry struct {
+	// src is the file with the content.
+	src string
+	// target is set for symlinks.
+	target string
+	// hash and perm are set for blobs of the object store, their own mode
+	// is read only.
+	hash string
+	perm os.FileMode
+}
+
+// snapshotEntries returns the files of a snapshot by their path relative to
+// the backup directory.
+func (b *Backedup) snapshotEntries(s Snapshot) (map[string]snapshotEntry, error) {
+	if s.Store == StoreObjects {
+		return b.treeEntries(s.ID)
+	}
+	dir := filepath.Join(b.snapshotsDir(), s.ID)
+	files, err := listFiles(b.fs, dir, &ignoreMatcher{})
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]snapshotEntry{}
+	for rel := range files {
+		src := filepath.Join(dir, rel)
+		fi, err := b.fs.Lstat(src)
+		if err != nil {
+			return nil, err
+		}
+		e := snapshotEntry{src: src}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if e.target, err = b.fs.Readlink(src); err != nil {
+				return nil, err
+			}
+		}
+		entries[rel] = e
+	}
+	return entries, nil
+}
+
+// matches reports whether the file at path has the content and permissions
+// of the entry.
+func (b *Backedup) matches(e snapshotEntry, path string) bool {
+	if e.hash == "" {
+		same, err := sameFile(b.fs, e.src, path)
+		return err == nil && same
+	}
+	fi, err := b.fs.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() || fi.Mode().Perm() != e.perm {
+		return false
+	}
+	hash, err := fileHash(b.fs, path)
+	return err == nil && hash == e.hash
+}
+
+// PlanRestoreSnapshot plans replacing the content of the backup directory
+// with the snapshot id.
+func (b *Backedup) PlanRestoreSnapshot(id string) (Plan, error) {
+	s, err := b.findSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := b.snapshotEntries(s)
+	if err != nil {
+		return nil, err
+	}
+	snapFiles := map[string]bool{}
+	for rel := range entries {
+		snapFiles[rel] = true
+	}
+	files, err := listFiles(b.fs, b.Config.BackupTo, internalMatcher())
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{}
+	for _, rel := range unionFiles(snapFiles, files) {
+		dst := filepath.Join(b.Config.BackupTo, rel)
+		e, ok := entries[rel]
+		if !ok {
+			plan.add(ActionRemove, dst, "", dst)
+			continue
+		}
+		if e.target != "" {
+			if current, err := b.fs.Readlink(dst); err == nil && current == e.target {
+				continue
+			}
+			if files[rel] {
+				plan.add(ActionRemove, dst, "", dst)
+			}
+			plan.add(ActionSymlink, dst, e.target, dst)
+			continue
+		}
+		if files[rel] && b.matches(e, dst) {
+			continue
+		}
+		plan = append(plan, Action{Type: ActionCopy, Path: dst, Src: e.src, Dst: dst, Replace: files[rel]})
+		if e.hash != "" {
+			plan = append(plan, Action{Type: ActionChmod, Path: dst, Dst: dst, Perm: e.perm})
+		}
+	}
+	return plan, nil
+}
+
+// RestoreSnapshot replaces the content of the backup directory with the
+// snapshot id. A snapshot of the current content is taken first so the
+// restore can be undone.
+func (b *Backedup) RestoreSnapshot(id string) error {
+	plan, err := b.PlanRestoreSnapshot(id)
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		return nil
+	}
+	unlock, err := b.storage.Lock()
+	if err != nil {
+		return err
+	}
+	// pruning could remove the snapshot being restored.
+	if _, err = b.snapshot(); err == nil {
+		err = b.applyOp("restore-snapshot", plan)
+	}
+	if uerr := unlock(); uerr != nil && err == nil {
+		err = uerr
+	}
+	if merr := b.writeManifest(); merr != nil && err == nil {
+		err = merr
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package backedup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestSnapshot(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.zshrc
+  - $HOME/.vim`)
+	defer cleanup()
+	zshrc := b.Config.Paths[0].Path
+	plugin := filepath.Join(b.Config.Paths[1].Path, "plugin.vim")
+	err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, plugin, []byte("plugin"), 0644)
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+
+	first, err := b.Snapshot()
+	Ok(t, err)
+	Equals(t, "v1", readString(t, b.fs, filepath.Join(b.snapshotsDir(), first.ID, "_HOME/.zshrc")))
+
+	// a bad edit through the symlink and a new file.
+	time.Sleep(2 * time.Millisecond)
+	err = afero.WriteFile(b.fs, zshrc, []byte("bad"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(b.Config.Paths[1].Path, "new.vim"), []byte("new"), 0644)
+	Ok(t, err)
+	second, err := b.Snapshot()
+	Ok(t, err)
+	snapshots, err := b.Snapshots()
+	Ok(t, err)
+	Equals(t, []Snapshot{first, second}, snapshots)
+	Equals(t, "v1", readString(t, b.fs, filepath.Join(b.snapshotsDir(), first.ID, "_HOME/.zshrc")))
+
+	plan, err := b.PlanRestoreSnapshot(first.ID)
+	Ok(t, err)
+	backupVim := b.backupPath(b.Config.Paths[1].Path)
+	Equals(t, Plan{
+		{Type: ActionRemove, Path: filepath.Join(backupVim, "new.vim"), Dst: filepath.Join(backupVim, "new.vim")},
+		{Type: ActionCopy, Path: b.backupPath(zshrc), Src: filepath.Join(b.snapshotsDir(), first.ID, "_HOME/.zshrc"), Dst: b.backupPath(zshrc), Replace: true},
+	}, plan)
+	time.Sleep(2 * time.Millisecond)
+	err = b.RestoreSnapshot(first.ID)
+	Ok(t, err)
+	checkNewSymlink(t, b.fs, zshrc)
+	Equals(t, "v1", readString(t, b.fs, zshrc))
+	snapshots, err = b.Snapshots()
+	Ok(t, err)
+	Equals(t, 3, len(snapshots))
+
+	_, err = b.PlanRestoreSnapshot("nope")
+	Equals(t, `unknown snapshot "nope"`, fmt.Sprint(err))
+
+	// no snapshot is taken while another run changes the backup.
+	err = afero.WriteFile(b.fs, zshrc, []byte("bad"), 0644)
+	Ok(t, err)
+	unlock, err := b.storage.Lock()
+	Ok(t, err)
+	_, err = b.Snapshot()
+	Equals(t, true, errors.Is(err, ErrLocked))
+	err = b.RestoreSnapshot(first.ID)
+	Equals(t, true, errors.Is(err, ErrLocked))
+	Ok(t, unlock())
+	snapshots, err = b.Snapshots()
+	Ok(t, err)
+	Equals(t, 3, len(snapshots))
+}
+
+func TestPrune(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+snapshots:
+  keep_last: 2
+  keep_daily: 3
+  keep_weekly: 2
+paths: []`)
+	defer cleanup()
+	// two a day for three weeks, the newest on a sunday.
+	newest := time.Date(2020, 3, 22, 18, 0, 0, 0, time.Local)
+	ids := map[string]time.Time{}
+	for day := 0; day < 21; day++ {
+		for _, hour := range []int{0, 6} {
+			ts := newest.AddDate(0, 0, -day).Add(-time.Duration(hour) * time.Hour)
+			id := ts.UTC().Format(snapshotIDFormat)
+			ids[id] = ts
+			err := b.fs.MkdirAll(filepath.Join(b.snapshotsDir(), id), 0755)
+			Ok(t, err)
+		}
+	}
+	_, err := b.Prune()
+	Ok(t, err)
+	snapshots, err := b.Snapshots()
+	Ok(t, err)
+	kept := []string{}
+	for _, s := range snapshots {
+		kept = append(kept, ids[s.ID].Format("01-02 15"))
+	}
+	// the last two, the newest of the last three days and of the last two
+	// weeks.
+	Equals(t, []string{"03-15 18", "03-20 18", "03-21 18", "03-22 12", "03-22 18"}, kept)
+}
+
+func TestRestoreSnapshotGit(t *testing.T) {
+	for _, store := range []string{"links", "objects"} {
+		t.Run(store, func(t *testing.T) {
+			b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+snapshot_store: `+store+`
+paths:
+  - $HOME/.zshrc`)
+			defer cleanup()
+			zshrc := b.Config.Paths[0].Path
+			err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0644)
+			Ok(t, err)
+			err = b.Backup()
+			Ok(t, err)
+			head := filepath.Join(b.Config.BackupTo, ".git", "HEAD")
+			err = afero.WriteFile(b.fs, head, []byte("ref: refs/heads/master"), 0644)
+			Ok(t, err)
+
+			first, err := b.Snapshot()
+			Ok(t, err)
+			_, err = b.fs.Stat(filepath.Join(b.snapshotsDir(), first.ID, ".git"))
+			Equals(t, true, os.IsNotExist(err))
+
+			// the repository is left alone, whatever changed in it.
+			err = afero.WriteFile(b.fs, head, []byte("ref: refs/heads/other"), 0644)
+			Ok(t, err)
+			time.Sleep(2 * time.Millisecond)
+			err = afero.WriteFile(b.fs, zshrc, []byte("bad"), 0644)
+			Ok(t, err)
+			plan, err := b.PlanRestoreSnapshot(first.ID)
+			Ok(t, err)
+			for _, a := range plan {
+				Equals(t, b.backupPath(zshrc), a.Path)
+			}
+			err = b.RestoreSnapshot(first.ID)
+			Ok(t, err)
+			Equals(t, "v1", readString(t, b.fs, zshrc))
+			Equals(t, "ref: refs/heads/other", readString(t, b.fs, head))
+		})
+	}
+}
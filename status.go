@@ -0,0 +1,188 @@
+package backedup
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// PathState describes how a configured path relates to its backup.
+type PathState string
+
+const (
+	// StateLinked is a symlink to its backup.
+	StateLinked PathState = "linked"
+	// StateNotBackedUp is a regular file or directory not yet backed up.
+	StateNotBackedUp PathState = "not-backed-up"
+	// StateLinkedElsewhere is a symlink pointing somewhere other than the backup.
+	StateLinkedElsewhere PathState = "linked-elsewhere"
+	// StateDangling is a symlink whose target does not exist.
+	StateDangling PathState = "dangling"
+	// StateMissingLocal is missing locally but present in the backup.
+	StateMissingLocal PathState = "missing-local"
+	// StateMissing is missing locally and in the backup.
+	StateMissing PathState = "missing"
+	// StateCopied is a copy mode path that is the same as its backup.
+	StateCopied PathState = "copied"
+	// StateOutOfSync is a copy mode path that differs from its backup.
+	StateOutOfSync PathState = "out-of-sync"
+	// StateEncrypted is an encrypted path that is the same as its backup.
+	StateEncrypted PathState = "encrypted"
+	// StateUnverified is an encrypted path that can't be compared to its
+	// backup without the passphrase.
+	StateUnverified PathState = "unverified"
+	// StateRendered is a template path with the content its template
+	// renders to.
+	StateRendered PathState = "rendered"
+	// StateDrifted is a template path that was changed since it was
+	// rendered, or whose template changed.
+	StateDrifted PathState = "drifted"
+)
+
+// PathStatus is the state of a single configured path.
+type PathStatus struct {
+	// Path is the configured path.
+	Path string `json:"path"`
+	// BackupPath is where the path is kept in the backup directory, or its
+	// key in the storage for copy mode paths.
+	BackupPath string `json:"backup_path"`
+	// State is the link state of the path.
+	State PathState `json:"state"`
+	// Target is the symlink target if Path is a symlink.
+	Target string `json:"target,omitempty"`
+}
+
+// Status reports the state of every configured path without changing
+// anything.
+func (b *Backedup) Status() ([]PathStatus, error) {
+	paths, err := b.resolvePaths(true, true)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]PathStatus, 0, len(paths))
+	for _, p := range paths {
+		status, err := b.status(p)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// status reports the state of a single path.
+func (b *Backedup) status(p PathConfig) (PathStatus, error) {
+	path := p.Path
+	status := PathStatus{Path: path, BackupPath: b.restorePath(path)}
+	copied := b.Config.mode(p) == ModeCopy && !p.Template && !p.Encrypt
+	var key string
+	if copied {
+		key = b.restoreKey(path)
+		status.BackupPath = key
+	}
+	fi, err := b.fs.Lstat(path)
+	if os.IsNotExist(err) {
+		status.State = StateMissing
+		if copied {
+			if files, err := b.listObjects(key, b.excludes(p)); err != nil {
+				return status, err
+			} else if len(files) > 0 {
+				status.State = StateMissingLocal
+			}
+		} else if _, err := b.fs.Lstat(status.BackupPath); err == nil {
+			status.State = StateMissingLocal
+		} else if !os.IsNotExist(err) {
+			return status, err
+		}
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		status.State = StateNotBackedUp
+		if p.Encrypt {
+			if _, err := b.fs.Lstat(status.BackupPath); os.IsNotExist(err) {
+				return status, nil
+			}
+			status.State, err = b.encryptedStatus(p, status.BackupPath)
+			return status, err
+		}
+		if p.Template {
+			if _, err := b.fs.Lstat(status.BackupPath); os.IsNotExist(err) {
+				return status, nil
+			}
+			ok, err := b.rendered(path, status.BackupPath)
+			if err != nil {
+				return status, err
+			}
+			status.State = StateDrifted
+			if ok {
+				status.State = StateRendered
+			}
+			return status, nil
+		}
+		if !copied {
+			if fi.IsDir() && b.dirLinked(path, status.BackupPath) {
+				status.State = StateLinked
+			}
+			return status, nil
+		}
+		m := b.excludes(p)
+		if files, err := b.listObjects(key, m); err != nil || len(files) == 0 {
+			return status, err
+		}
+		ok, err := b.inSync(path, key, m)
+		if err != nil {
+			return status, err
+		}
+		status.State = StateOutOfSync
+		if ok {
+			status.State = StateCopied
+		}
+		return status, nil
+	}
+	if status.Target, err = b.fs.Readlink(path); err != nil {
+		return status, err
+	}
+	// Stat follows the symlink to check the target is there.
+	if _, err := b.fs.Stat(path); os.IsNotExist(err) {
+		status.State = StateDangling
+		return status, nil
+	} else if err != nil {
+		return status, err
+	}
+	status.State = StateLinkedElsewhere
+	if status.Target == status.BackupPath {
+		status.State = StateLinked
+	}
+	return status, nil
+}
+
+// dirLinked reports whether a directory that was backed up entry by entry
+// links to every backed up entry.
+func (b *Backedup) dirLinked(dir, backupDir string) bool {
+	fis, err := afero.ReadDir(b.fs, backupDir)
+	if err != nil {
+		return false
+	}
+	for _, fi := range fis {
+		child := filepath.Join(dir, fi.Name())
+		backupChild := filepath.Join(backupDir, fi.Name())
+		lfi, err := b.fs.Lstat(child)
+		if err != nil {
+			return false
+		}
+		if lfi.Mode()&os.ModeSymlink != 0 {
+			if target, _ := b.fs.Readlink(child); target != backupChild {
+				return false
+			}
+			continue
+		}
+		if !lfi.IsDir() || !fi.IsDir() || !b.dirLinked(child, backupChild) {
+			return false
+		}
+	}
+	return true
+}
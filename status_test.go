@@ -0,0 +1,80 @@
+package backedup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestStatus(t *testing.T) {
+	var stdin bytes.Buffer
+	var logger bytes.Buffer
+	fs := NewOsFs()
+	tmpDir, err := afero.TempDir(fs, "", "")
+	Ok(t, err)
+	defer fs.RemoveAll(tmpDir)
+	home := filepath.Join(tmpDir, "home")
+	os.Setenv("HOME", home)
+	backupTo := filepath.Join(tmpDir, "backedup")
+	backupHome := filepath.Join(backupTo, backupHomeDirName)
+	err = fs.MkdirAll(backupHome, 0755)
+	Ok(t, err)
+	err = fs.MkdirAll(home, 0755)
+	Ok(t, err)
+
+	linked := filepath.Join(home, ".linked")
+	err = afero.WriteFile(fs, filepath.Join(backupHome, ".linked"), []byte("linked"), 0644)
+	Ok(t, err)
+	err = os.Symlink(filepath.Join(backupHome, ".linked"), linked)
+	Ok(t, err)
+
+	regular := filepath.Join(home, ".regular")
+	err = afero.WriteFile(fs, regular, []byte("regular"), 0644)
+	Ok(t, err)
+
+	elsewhere := filepath.Join(home, ".elsewhere")
+	err = os.Symlink(regular, elsewhere)
+	Ok(t, err)
+
+	dangling := filepath.Join(home, ".dangling")
+	err = os.Symlink(filepath.Join(tmpDir, "nothing"), dangling)
+	Ok(t, err)
+
+	missingLocal := filepath.Join(home, ".missinglocal")
+	err = afero.WriteFile(fs, filepath.Join(backupHome, ".missinglocal"), []byte("backup"), 0644)
+	Ok(t, err)
+
+	missing := filepath.Join(home, ".missing")
+
+	confPath := filepath.Join(home, ".backedup.yaml")
+	cfg := fmt.Sprintf(`
+backup_to: %s
+paths:
+  - %s
+  - %s
+  - %s
+  - %s
+  - %s
+  - %s`, backupTo, linked, regular, elsewhere, dangling, missingLocal, missing)
+	err = afero.WriteFile(fs, confPath, []byte(cfg), 0644)
+	Ok(t, err)
+
+	b, err := New(fs, &stdin, &logger, confPath)
+	Ok(t, err)
+	statuses, err := b.Status()
+	Ok(t, err)
+
+	want := []PathStatus{
+		{Path: linked, BackupPath: filepath.Join(backupHome, ".linked"), State: StateLinked, Target: filepath.Join(backupHome, ".linked")},
+		{Path: regular, BackupPath: filepath.Join(backupHome, ".regular"), State: StateNotBackedUp},
+		{Path: elsewhere, BackupPath: filepath.Join(backupHome, ".elsewhere"), State: StateLinkedElsewhere, Target: regular},
+		{Path: dangling, BackupPath: filepath.Join(backupHome, ".dangling"), State: StateDangling, Target: filepath.Join(tmpDir, "nothing")},
+		{Path: missingLocal, BackupPath: filepath.Join(backupHome, ".missinglocal"), State: StateMissingLocal},
+		{Path: missing, BackupPath: filepath.Join(backupHome, ".missing"), State: StateMissing},
+	}
+	Equals(t, want, statuses)
+}
@@ -0,0 +1,585 @@
+package backedup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// StorageLocal is the storage type of a directory on disk, the default.
+const StorageLocal = "local"
+
+// lockKey is the key of the lock of a storage.
+const lockKey = ".backedup-lock"
+
+// etagCacheName is the file in the backup directory with the hashes of
+// the objects of the last runs by ETag.
+const etagCacheName = ".backedup-etags.json"
+
+// Storage keeps the backed up files of copy mode paths, archives and the
+// sync state under slash separated keys relative to the backup directory,
+// like _HOME/.zshrc. Link mode paths, templates, encrypted paths and
+// snapshots need the backup directory on disk and don't use it.
+//
+// Missing keys are reported with errors for which os.IsNotExist is true.
+type Storage interface {
+	// Put stores the content of r under info.Key with the permissions of
+	// info.Mode, or a symlink to info.Target. A zero info.ModTime means now.
+	// Storages without directories ignore the ones with os.ModeDir set.
+	Put(info ObjectInfo, r io.Reader) error
+	// Get returns the content of a key.
+	Get(key string) (io.ReadCloser, error)
+	// Stat returns the info of a key.
+	Stat(key string) (ObjectInfo, error)
+	// List returns the objects under prefix sorted by key, prefix itself if
+	// it is an object or the objects below it. "" lists everything.
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete removes a key.
+	Delete(key string) error
+	// Lock takes a lock for a run that changes the storage, it returns
+	// ErrLocked if another run has it. The returned function releases it.
+	Lock() (func() error, error)
+}
+
+// ObjectInfo describes a key of a Storage.
+type ObjectInfo struct {
+	// Key is the slash separated key.
+	Key string `json:"key"`
+	// Size is the size of the content.
+	Size int64 `json:"size"`
+	// Mode has the permissions and the type bits, like os.ModeSymlink.
+	Mode os.FileMode `json:"mode"`
+	// ModTime is the modification time.
+	ModTime time.Time `json:"mod_time"`
+	// Target is set for symlinks.
+	Target string `json:"target,omitempty"`
+	// ETag changes with the content, storages that have them set it so
+	// unchanged objects aren't downloaded to compare them.
+	ETag string `json:"etag,omitempty"`
+}
+
+// StorageConfig selects the Storage of the backup set.
+type StorageConfig struct {
+	// Type is a type registered with RegisterStorage, StorageLocal if
+	// empty.
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	// Options are passed to the storage.
+	Options map[string]string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// local reports whether the storage is the backup directory on disk.
+func (c StorageConfig) local() bool {
+	return c.Type == "" || c.Type == StorageLocal
+}
+
+// StorageOpener opens a storage for the backup directory backupTo.
+type StorageOpener func(c StorageConfig, fs FS, backupTo string) (Storage, error)
+
+// storageTypes are the registered storage types.
+var storageTypes = map[string]StorageOpener{
+	StorageLocal: func(c StorageConfig, fs FS, backupTo string) (Storage, error) {
+		return NewLocalStorage(fs, backupTo), nil
+	},
+	StorageS3:     openS3Storage,
+	StorageWebDAV: openWebDAVStorage,
+}
+
+// RegisterStorage makes a storage type available to StorageConfig.Type.
+func RegisterStorage(typ string, open StorageOpener) {
+	storageTypes[typ] = open
+}
+
+// openStorage opens the storage of c.
+func openStorage(c StorageConfig, fs FS, backupTo string) (Storage, error) {
+	typ := c.Type
+	if typ == "" {
+		typ = StorageLocal
+	}
+	open, ok := storageTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q", c.Type)
+	}
+	return open(c, fs, backupTo)
+}
+
+// backupToScheme returns the scheme of a backup_to URL like
+// s3://bucket/prefix, which is the storage type it is kept in.
+func backupToScheme(backupTo string) (string, bool) {
+	u, err := url.Parse(backupTo)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	return u.Scheme, true
+}
+
+// remoteBackupTo sets the storage type of a backup_to URL and replaces
+// BackupTo with a local directory for the journal of runs. It returns where
+// the storage is, BackupTo unless it was a URL.
+func (c *Config) remoteBackupTo() string {
+	scheme, ok := backupToScheme(c.BackupTo)
+	if !ok {
+		return c.BackupTo
+	}
+	u, _ := url.Parse(c.BackupTo)
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	c.remote, c.Storage.Type = c.BackupTo, scheme
+	c.BackupTo = filepath.Join(dir, "backedup", scheme, u.Host, filepath.FromSlash(u.Path))
+	return c.remote
+}
+
+// validateStorage returns an error for a path that can't be kept in the
+// storage, only copy mode paths can be kept in one that isn't on disk.
+func (c *Config) validateStorage(p PathConfig) error {
+	backupTo := c.BackupTo
+	if c.remote != "" {
+		backupTo = c.remote
+	}
+	scheme, ok := backupToScheme(backupTo)
+	if !ok {
+		return nil
+	}
+	if c.mode(p) != ModeCopy || p.Template || p.Encrypt {
+		return fmt.Errorf("%s has to be mode copy for backup_to %s://", p.Path, scheme)
+	}
+	return nil
+}
+
+// internalKey reports whether key is one of the files backedup keeps for
+// itself, like the sync state, or the repository of the git backend.
+func internalKey(key string) bool {
+	return strings.HasPrefix(key, ".backedup-") || key == ".git" || strings.HasPrefix(key, ".git/")
+}
+
+// checkStorage returns an error if the storage is the backup directory and
+// it is missing.
+func (b *Backedup) checkStorage() error {
+	if !b.Config.Storage.local() {
+		return nil
+	}
+	return b.checkBackupTo()
+}
+
+// storageKey returns the key of a path in the backup directory.
+func (b *Backedup) storageKey(backupPath string) string {
+	rel, err := filepath.Rel(b.Config.BackupTo, backupPath)
+	if err != nil {
+		return filepath.ToSlash(backupPath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// restoreKey returns the key of the host variant of path if there is one
+// and the shared one otherwise.
+func (b *Backedup) restoreKey(path string) string {
+	hostKey := b.storageKey(b.hostPath(path))
+	if objects, err := b.storage.List(hostKey); err == nil && len(objects) > 0 {
+		return hostKey
+	}
+	return b.storageKey(b.backupPath(path))
+}
+
+// objectKey returns the key of rel inside the key dir.
+func objectKey(dir, rel string) string {
+	return path.Join(dir, filepath.ToSlash(rel))
+}
+
+// listObjects returns the objects under key relative to it like listFiles,
+// leaving out the ones m or the .backedupignore objects under key exclude.
+func (b *Backedup) listObjects(key string, m *ignoreMatcher) (map[string]bool, error) {
+	objects, err := b.storage.List(key)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]bool{}
+	rels := []string{}
+	ignoreFiles := []string{}
+	for _, o := range objects {
+		if o.ETag != "" {
+			b.etagCache().current[o.Key] = o.ETag
+		}
+		switch {
+		case o.Mode.IsDir():
+		case o.Key == key:
+			files[""] = true
+		default:
+			rel := strings.TrimPrefix(o.Key, key+"/")
+			rels = append(rels, rel)
+			if path.Base(rel) == ignoreFilename {
+				ignoreFiles = append(ignoreFiles, rel)
+			}
+		}
+	}
+	// the rules of a directory come after the ones of the directories it
+	// is in.
+	sort.SliceStable(ignoreFiles, func(i, j int) bool {
+		return strings.Count(ignoreFiles[i], "/") < strings.Count(ignoreFiles[j], "/")
+	})
+	for _, rel := range ignoreFiles {
+		data, err := b.readObject(objectKey(key, rel))
+		if err != nil {
+			return nil, err
+		}
+		m = m.withData(data, path.Dir(rel))
+	}
+	for _, rel := range rels {
+		if !m.excluded(rel) {
+			files[filepath.FromSlash(rel)] = true
+		}
+	}
+	return files, nil
+}
+
+// readObject returns the content of a key.
+func (b *Backedup) readObject(key string) ([]byte, error) {
+	rc, err := b.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// objectHash returns the hex encoded sha256 of the content of a key, or ""
+// if exists is false. Keys listed with the same ETag as when they were last
+// hashed aren't downloaded again.
+func (b *Backedup) objectHash(key string, exists bool) (string, error) {
+	if !exists {
+		return "", nil
+	}
+	c := b.etagCache()
+	etag := c.current[key]
+	if h, ok := c.hashes[key]; ok && etag != "" && h.ETag == etag {
+		return h.Hash, nil
+	}
+	rc, err := b.storage.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	hash, err := readerHash(rc)
+	if err == nil && etag != "" {
+		c.hashes[key] = etagHash{ETag: etag, Hash: hash}
+		c.changed = true
+	}
+	return hash, err
+}
+
+// etagCache has the hashes of objects by ETag.
+type etagCache struct {
+	// current are the ETags of the objects listed in this run.
+	current map[string]string
+	hashes  map[string]etagHash
+	changed bool
+}
+
+// etagHash is the hash of an object when it had ETag.
+type etagHash struct {
+	ETag string `json:"etag"`
+	Hash string `json:"hash"`
+}
+
+// etagCache loads the ETag cache of the backup directory on first use, a
+// missing or broken one is empty.
+func (b *Backedup) etagCache() *etagCache {
+	if b.etags != nil {
+		return b.etags
+	}
+	b.etags = &etagCache{current: map[string]string{}, hashes: map[string]etagHash{}}
+	if data, err := afero.ReadFile(b.fs, filepath.Join(b.Config.BackupTo, etagCacheName)); err == nil {
+		json.Unmarshal(data, &b.etags.hashes)
+	}
+	return b.etags
+}
+
+// writeETagCache saves the ETag cache if objects were hashed.
+func (b *Backedup) writeETagCache() error {
+	if b.etags == nil || !b.etags.changed {
+		return nil
+	}
+	data, err := json.MarshalIndent(b.etags.hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := b.fs.MkdirAll(b.Config.BackupTo, 0755); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(b.fs, filepath.Join(b.Config.BackupTo, etagCacheName), data, 0644); err != nil {
+		return err
+	}
+	b.etags.changed = false
+	return nil
+}
+
+// put stores the file src under key with its permissions and mtime,
+// symlinks are followed.
+func (b *Backedup) put(src, key string) error {
+	fi, err := b.fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	f, err := b.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.storage.Put(ObjectInfo{Key: key, Size: fi.Size(), Mode: fi.Mode().Perm(), ModTime: fi.ModTime()}, f)
+}
+
+// get copies key to the file dst with its permissions and mtime. If replace
+// is set the existing dst is swapped for it at once.
+func (b *Backedup) get(key, dst string, replace bool) error {
+	info, err := b.storage.Stat(key)
+	if err != nil {
+		return err
+	}
+	if info.Target != "" {
+		if replace {
+			if err := b.fs.Remove(dst); err != nil {
+				return err
+			}
+		}
+		if err := b.fs.Symlink(info.Target, dst); err != nil {
+			return err
+		}
+		if info.ModTime.IsZero() {
+			return nil
+		}
+		return b.fs.Lchtimes(dst, info.ModTime, info.ModTime)
+	}
+	rc, err := b.storage.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	perm := info.Mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	tmpPath := dst
+	if replace {
+		tmpPath = dst + ".backedup-tmp"
+	}
+	f, err := b.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = b.fs.Chmod(tmpPath, perm)
+	}
+	if err == nil && !info.ModTime.IsZero() {
+		err = b.fs.Chtimes(tmpPath, info.ModTime, info.ModTime)
+	}
+	if err != nil {
+		if replace {
+			b.fs.Remove(tmpPath)
+		}
+		return err
+	}
+	if replace {
+		return b.fs.Rename(tmpPath, dst)
+	}
+	return nil
+}
+
+// localStorage is a Storage in a directory of an FS.
+type localStorage struct {
+	fs   FS
+	root string
+}
+
+// NewLocalStorage returns a Storage keeping the keys as files under root.
+func NewLocalStorage(fs FS, root string) Storage {
+	return &localStorage{fs: fs, root: root}
+}
+
+// path returns the file of key.
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// info returns the ObjectInfo of the file of key.
+func (s *localStorage) info(key string, fi os.FileInfo) (ObjectInfo, error) {
+	info := ObjectInfo{Key: key, Size: fi.Size(), Mode: fi.Mode()&os.ModeType | fi.Mode().Perm(), ModTime: fi.ModTime()}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := s.fs.Readlink(s.path(key))
+		if err != nil {
+			return info, err
+		}
+		info.Target = target
+	case fi.IsDir():
+		// directories afero.MemMapFs creates implicitly have no mode bits.
+		info.Mode |= os.ModeDir
+	}
+	return info, nil
+}
+
+// Put implements Storage.
+func (s *localStorage) Put(info ObjectInfo, r io.Reader) error {
+	path := s.path(info.Key)
+	perm := info.Mode.Perm()
+	if info.Mode.IsDir() {
+		if err := s.fs.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		return s.setMeta(path, perm, info.ModTime)
+	}
+	if err := s.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if info.Target != "" {
+		if fi, err := s.fs.Lstat(path); err == nil && !fi.IsDir() {
+			if err := s.fs.Remove(path); err != nil {
+				return err
+			}
+		}
+		if err := s.fs.Symlink(info.Target, path); err != nil {
+			return err
+		}
+		if info.ModTime.IsZero() {
+			return nil
+		}
+		return s.fs.Lchtimes(path, info.ModTime, info.ModTime)
+	}
+	if perm == 0 {
+		perm = 0644
+	}
+	// the file is swapped in at once so a failed put leaves the old one.
+	tmpPath := path + ".backedup-tmp"
+	f, err := s.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		s.fs.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		s.fs.Remove(tmpPath)
+		return err
+	}
+	if err := s.setMeta(tmpPath, perm, info.ModTime); err != nil {
+		s.fs.Remove(tmpPath)
+		return err
+	}
+	return s.fs.Rename(tmpPath, path)
+}
+
+// setMeta sets the permissions and, unless it is zero, the modification
+// time of path.
+func (s *localStorage) setMeta(path string, perm os.FileMode, mtime time.Time) error {
+	if err := s.fs.Chmod(path, perm); err != nil {
+		return err
+	}
+	if mtime.IsZero() {
+		return nil
+	}
+	return s.fs.Chtimes(path, mtime, mtime)
+}
+
+// Get implements Storage.
+func (s *localStorage) Get(key string) (io.ReadCloser, error) {
+	return s.fs.Open(s.path(key))
+}
+
+// Stat implements Storage.
+func (s *localStorage) Stat(key string) (ObjectInfo, error) {
+	fi, err := s.fs.Lstat(s.path(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.info(key, fi)
+}
+
+// List implements Storage.
+func (s *localStorage) List(prefix string) ([]ObjectInfo, error) {
+	root := s.path(prefix)
+	fi, err := s.fs.Lstat(root)
+	if os.IsNotExist(err) {
+		return []ObjectInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		info, err := s.info(prefix, fi)
+		return []ObjectInfo{info}, err
+	}
+	objects := []ObjectInfo{}
+	err = afero.Walk(s.fs, root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || name == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		info, err := s.info(path.Join(prefix, filepath.ToSlash(rel)), fi)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, info)
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+// Delete implements Storage.
+func (s *localStorage) Delete(key string) error {
+	return s.fs.Remove(s.path(key))
+}
+
+// Lock implements Storage.
+func (s *localStorage) Lock() (func() error, error) {
+	path := s.path(lockKey)
+	if err := s.fs.MkdirAll(s.root, 0755); err != nil {
+		return nil, err
+	}
+	// afero.MemMapFs ignores O_EXCL.
+	_, err := s.fs.Lstat(path)
+	if err == nil {
+		err = os.ErrExist
+	} else if os.IsNotExist(err) {
+		var f afero.File
+		if f, err = s.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+			return s.writeLock(f, path)
+		}
+	}
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%w, remove %s if no other run is going on", ErrLocked, path)
+	}
+	return nil, err
+}
+
+// writeLock records who holds the lock in f.
+func (s *localStorage) writeLock(f afero.File, path string) (func() error, error) {
+	hostname, _ := os.Hostname()
+	_, err := fmt.Fprintf(f, "%s %d %s\n", hostname, os.Getpid(), time.Now().Format(time.RFC3339))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.fs.Remove(path)
+		return nil, err
+	}
+	return func() error { return s.fs.Remove(path) }, nil
+}
@@ -0,0 +1,194 @@
+package backedup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// mapStorage is a Storage in memory without directories.
+type mapStorage struct {
+	objects map[string]ObjectInfo
+	data    map[string][]byte
+	locked  bool
+}
+
+func newMapStorage() *mapStorage {
+	return &mapStorage{objects: map[string]ObjectInfo{}, data: map[string][]byte{}}
+}
+
+func (s *mapStorage) Put(info ObjectInfo, r io.Reader) error {
+	if info.Mode.IsDir() {
+		return nil
+	}
+	data := []byte{}
+	if r != nil {
+		var err error
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	info.Size = int64(len(data))
+	s.objects[info.Key], s.data[info.Key] = info, data
+	return nil
+}
+
+func (s *mapStorage) Get(key string) (io.ReadCloser, error) {
+	data, ok := s.data[key]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *mapStorage) Stat(key string) (ObjectInfo, error) {
+	info, ok := s.objects[key]
+	if !ok {
+		return info, &os.PathError{Op: "stat", Path: key, Err: os.ErrNotExist}
+	}
+	return info, nil
+}
+
+func (s *mapStorage) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	for key, info := range s.objects {
+		if prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/") {
+			objects = append(objects, info)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *mapStorage) Delete(key string) error {
+	if _, ok := s.objects[key]; !ok {
+		return &os.PathError{Op: "delete", Path: key, Err: os.ErrNotExist}
+	}
+	delete(s.objects, key)
+	delete(s.data, key)
+	return nil
+}
+
+func (s *mapStorage) Lock() (func() error, error) {
+	if s.locked {
+		return nil, ErrLocked
+	}
+	s.locked = true
+	return func() error { s.locked = false; return nil }, nil
+}
+
+func TestLocalStorage(t *testing.T) {
+	fs := NewMemFs()
+	s := NewLocalStorage(fs, "/backup")
+	err := s.Put(ObjectInfo{Key: "_HOME/.zshrc", Mode: 0600}, strings.NewReader("v1"))
+	Ok(t, err)
+	err = s.Put(ObjectInfo{Key: "_HOME/.zshrc.local", Mode: 0644}, strings.NewReader("local"))
+	Ok(t, err)
+	err = s.Put(ObjectInfo{Key: "_HOME/.vim", Target: "/elsewhere"}, nil)
+	Ok(t, err)
+	Equals(t, "v1", readString(t, fs, "/backup/_HOME/.zshrc"))
+
+	info, err := s.Stat("_HOME/.zshrc")
+	Ok(t, err)
+	Equals(t, os.FileMode(0600), info.Mode)
+	Equals(t, int64(2), info.Size)
+	info, err = s.Stat("_HOME/.vim")
+	Ok(t, err)
+	Equals(t, "/elsewhere", info.Target)
+	_, err = s.Stat("_HOME/.bashrc")
+	Equals(t, true, os.IsNotExist(err))
+
+	// a key lists itself, not the keys it is a prefix of.
+	objects, err := s.List("_HOME/.zshrc")
+	Ok(t, err)
+	Equals(t, 1, len(objects))
+	objects, err = s.List("_HOME")
+	Ok(t, err)
+	keys := []string{}
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	Equals(t, []string{"_HOME/.vim", "_HOME/.zshrc", "_HOME/.zshrc.local"}, keys)
+
+	err = s.Delete("_HOME/.zshrc.local")
+	Ok(t, err)
+	_, err = s.Get("_HOME/.zshrc.local")
+	Equals(t, true, os.IsNotExist(err))
+
+	unlock, err := s.Lock()
+	Ok(t, err)
+	_, err = s.Lock()
+	Equals(t, true, errors.Is(err, ErrLocked))
+	Ok(t, unlock())
+	unlock, err = s.Lock()
+	Ok(t, err)
+	Ok(t, unlock())
+}
+
+func TestRegisterStorage(t *testing.T) {
+	s := newMapStorage()
+	RegisterStorage("map", func(c StorageConfig, fs FS, backupTo string) (Storage, error) {
+		return s, nil
+	})
+	defer delete(storageTypes, "map")
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+mode: copy
+storage:
+  type: map
+paths:
+  - $HOME/.zshrc
+  - path: $HOME/.config/app
+    exclude: ["*.log"]`)
+	defer cleanup()
+	zshrc, app := b.Config.Paths[0].Path, b.Config.Paths[1].Path
+	err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0600)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(app, "settings.json"), []byte("{}"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(app, "debug.log"), []byte("log"), 0644)
+	Ok(t, err)
+
+	err = b.Backup()
+	Ok(t, err)
+	Equals(t, "v1", string(s.data["_HOME/.zshrc"]))
+	Equals(t, os.FileMode(0600), s.objects["_HOME/.zshrc"].Mode)
+	Equals(t, "{}", string(s.data["_HOME/.config/app/settings.json"]))
+	_, ok := s.data["_HOME/.config/app/debug.log"]
+	Equals(t, false, ok)
+	_, ok = s.data[".backedup-sync/"+b.hostname+".json"]
+	Equals(t, true, ok)
+	exists, err := afero.Exists(b.fs, b.backupPath(zshrc))
+	Ok(t, err)
+	Equals(t, false, exists)
+	statuses, err := b.Status()
+	Ok(t, err)
+	Equals(t, StateCopied, statuses[0].State)
+	Equals(t, StateCopied, statuses[1].State)
+
+	// changes made through the storage are pulled.
+	err = s.Put(ObjectInfo{Key: "_HOME/.config/app/settings.json", Mode: 0644}, strings.NewReader(`{"a":1}`))
+	Ok(t, err)
+	err = b.Sync()
+	Ok(t, err)
+	Equals(t, `{"a":1}`, readString(t, b.fs, filepath.Join(app, "settings.json")))
+
+	err = b.fs.RemoveAll(app)
+	Ok(t, err)
+	err = b.Restore()
+	Ok(t, err)
+	Equals(t, `{"a":1}`, readString(t, b.fs, filepath.Join(app, "settings.json")))
+
+	// a run doesn't start while another one holds the lock.
+	s.locked = true
+	err = b.Sync()
+	Equals(t, true, errors.Is(err, ErrLocked))
+}
@@ -0,0 +1,294 @@
+package backedup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// syncStateDirName holds the sync state of every host in the backup
+	// directory, one file per host so they don't conflict.
+	syncStateDirName = ".backedup-sync"
+)
+
+// syncState maps the files of copy mode paths to the sha256 of their
+// contents when they were last in sync with the backup.
+type syncState map[string]string
+
+// syncStateKey returns the key of the sync state of this host.
+func (b *Backedup) syncStateKey() string {
+	return path.Join(syncStateDirName, b.hostname+".json")
+}
+
+// readSyncState loads the sync state of this host.
+func (b *Backedup) readSyncState() (syncState, error) {
+	state := syncState{}
+	data, err := b.readObject(b.syncStateKey())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// writeSyncState saves the sync state of this host.
+func (b *Backedup) writeSyncState(state syncState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	info := ObjectInfo{Key: b.syncStateKey(), Size: int64(len(data)), Mode: 0644}
+	return b.storage.Put(info, bytes.NewReader(data))
+}
+
+// Sync brings the copy mode paths and their backups up to date. Files
+// changed locally since the last sync are pushed to the backup, files
+// changed in the backup are pulled, and deletions on one side are applied
+// to the other. Files changed on both sides fail with ErrSyncConflict.
+func (b *Backedup) Sync() error {
+	plan, err := b.PlanSync()
+	if err != nil {
+		return err
+	}
+	err = b.run("sync", plan)
+	if serr := b.updateSyncState(); serr != nil && err == nil {
+		err = serr
+	}
+	if merr := b.writeManifest(); merr != nil && err == nil {
+		err = merr
+	}
+	return b.autoCommit("sync", err)
+}
+
+// PlanSync returns the actions Sync would take without changing anything.
+func (b *Backedup) PlanSync() (Plan, error) {
+	if err := b.checkStorage(); err != nil {
+		return nil, err
+	}
+	state, err := b.readSyncState()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := b.resolvePaths(true, true)
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{}
+	for _, p := range paths {
+		if b.Config.mode(p) != ModeCopy || p.Template || p.Encrypt {
+			continue
+		}
+		n := len(plan)
+		b.planSyncPath(&plan, state, p.Path, b.restoreKey(p.Path), b.excludes(p))
+		if !p.AllowSecrets {
+			b.blockSecrets(plan[n:])
+		}
+	}
+	return plan, nil
+}
+
+// planSyncPath adds the sync actions for every file under live and the key
+// of its backup. Each file is planned as its own path so a conflict only
+// skips that file.
+func (b *Backedup) planSyncPath(plan *Plan, state syncState, live, key string, m *ignoreMatcher) {
+	liveFiles, err := listFiles(b.fs, live, m)
+	if err != nil {
+		plan.fail(live, err)
+		return
+	}
+	backupFiles, err := b.listObjects(key, m)
+	if err != nil {
+		plan.fail(live, err)
+		return
+	}
+	for _, rel := range unionFiles(liveFiles, backupFiles) {
+		l, k := filepath.Join(live, rel), objectKey(key, rel)
+		lh, err := hashIfExists(b.fs, l, liveFiles[rel])
+		if err != nil {
+			plan.fail(l, err)
+			continue
+		}
+		kh, err := b.objectHash(k, backupFiles[rel])
+		if err != nil {
+			plan.fail(l, err)
+			continue
+		}
+		base := state[l]
+		switch {
+		case lh == kh:
+		case kh == "" && base == "":
+			*plan = append(*plan, Action{Type: ActionPut, Path: l, Src: l, Dst: k, Reason: "push"})
+		case kh == "" && base == lh:
+			*plan = append(*plan, Action{Type: ActionRemove, Path: l, Dst: l, Reason: "deleted in backup"})
+		case lh == "" && base == "":
+			*plan = append(*plan, Action{Type: ActionGet, Path: l, Src: k, Dst: l, Reason: "pull"})
+		case lh == "" && base == kh:
+			*plan = append(*plan, Action{Type: ActionDelete, Path: l, Dst: k, Reason: "deleted locally"})
+		case lh != "" && kh != "" && base == kh:
+			*plan = append(*plan, Action{Type: ActionPut, Path: l, Src: l, Dst: k, Reason: "push", Replace: true})
+		case lh != "" && kh != "" && base == lh:
+			*plan = append(*plan, Action{Type: ActionGet, Path: l, Src: k, Dst: l, Reason: "pull", Replace: true})
+		default:
+			plan.fail(l, ErrSyncConflict)
+		}
+	}
+}
+
+// blockSecrets turns pushes of files with possible secrets into failures.
+func (b *Backedup) blockSecrets(plan Plan) {
+	for i, a := range plan {
+		if a.Type != ActionPut {
+			continue
+		}
+		findings, err := scanFile(b.fs, a.Src)
+		if err == nil && len(findings) > 0 {
+			f := findings[0]
+			err = fmt.Errorf("%w, line %d (%s), set allow_secrets", ErrSecretFound, f.Line, f.Rule)
+		}
+		if err != nil {
+			plan[i] = Action{Type: ActionSkip, Path: a.Path, Reason: err.Error(), Err: err}
+		}
+	}
+}
+
+// updateSyncState records every file of the copy mode paths that is the
+// same locally and in the backup, and forgets files that are gone from both.
+func (b *Backedup) updateSyncState() error {
+	if err := b.checkStorage(); err != nil {
+		// nothing was backed up, there is nothing to record.
+		return nil
+	}
+	state, err := b.readSyncState()
+	if err != nil {
+		return err
+	}
+	paths, err := b.resolvePaths(true, true)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if b.Config.mode(p) != ModeCopy || p.Template || p.Encrypt {
+			continue
+		}
+		live, key, m := p.Path, b.restoreKey(p.Path), b.excludes(p)
+		liveFiles, err := listFiles(b.fs, live, m)
+		if err != nil {
+			continue
+		}
+		backupFiles, err := b.listObjects(key, m)
+		if err != nil {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, rel := range unionFiles(liveFiles, backupFiles) {
+			l := filepath.Join(live, rel)
+			seen[l] = true
+			lh, lerr := hashIfExists(b.fs, l, liveFiles[rel])
+			kh, kerr := b.objectHash(objectKey(key, rel), backupFiles[rel])
+			if lerr == nil && kerr == nil && lh != "" && lh == kh {
+				state[l] = lh
+			}
+		}
+		for l := range state {
+			if (l == live || strings.HasPrefix(l, live+string(filepath.Separator))) && !seen[l] {
+				delete(state, l)
+			}
+		}
+	}
+	if err := b.writeETagCache(); err != nil {
+		return err
+	}
+	return b.writeSyncState(state)
+}
+
+// inSync reports whether live and the key of its backup have the same files
+// and contents, leaving out the ones m excludes.
+func (b *Backedup) inSync(live, key string, m *ignoreMatcher) (bool, error) {
+	liveFiles, err := listFiles(b.fs, live, m)
+	if err != nil {
+		return false, err
+	}
+	backupFiles, err := b.listObjects(key, m)
+	if err != nil {
+		return false, err
+	}
+	if len(liveFiles) != len(backupFiles) {
+		return false, nil
+	}
+	for rel := range liveFiles {
+		if !backupFiles[rel] {
+			return false, nil
+		}
+		lh, err := fileHash(b.fs, filepath.Join(live, rel))
+		if err != nil {
+			return false, err
+		}
+		kh, err := b.objectHash(objectKey(key, rel), true)
+		if err != nil {
+			return false, err
+		}
+		if lh != kh {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// listFiles returns the files under root relative to it, leaving out the
+// ones m excludes. If root is a file it is returned as "", if it doesn't
+// exist the result is empty.
+func listFiles(fs FS, root string, m *ignoreMatcher) (map[string]bool, error) {
+	files := map[string]bool{}
+	fi, err := fs.Stat(root)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		files[""] = true
+		return files, nil
+	}
+	err = walkIgnore(fs, root, m, func(rel string, info os.FileInfo, ignored bool) error {
+		if !ignored && !info.IsDir() {
+			files[filepath.FromSlash(rel)] = true
+		}
+		return nil
+	})
+	return files, err
+}
+
+// unionFiles returns the sorted union of two file lists.
+func unionFiles(a, b map[string]bool) []string {
+	union := make([]string, 0, len(a)+len(b))
+	for rel := range a {
+		union = append(union, rel)
+	}
+	for rel := range b {
+		if !a[rel] {
+			union = append(union, rel)
+		}
+	}
+	sort.Strings(union)
+	return union
+}
+
+// hashIfExists returns the fileHash of path, or "" if it doesn't exist.
+func hashIfExists(fs FS, path string, exists bool) (string, error) {
+	if !exists {
+		return "", nil
+	}
+	return fileHash(fs, path)
+}
@@ -0,0 +1,95 @@
+package backedup
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func readString(t *testing.T, fs FS, path string) string {
+	data, err := afero.ReadFile(fs, path)
+	Ok(t, err)
+	return string(data)
+}
+
+func TestSync(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+mode: copy
+paths:
+  - $HOME/.zshrc
+  - $HOME/.config/app`)
+	defer cleanup()
+	zshrc := b.Config.Paths[0].Path
+	app := b.Config.Paths[1].Path
+	err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(app, "settings.json"), []byte("{}"), 0644)
+	Ok(t, err)
+
+	// backup copies and leaves the originals in place.
+	err = b.Backup()
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, zshrc)
+	Equals(t, "v1", readString(t, b.fs, b.backupPath(zshrc)))
+	Equals(t, "{}", readString(t, b.fs, filepath.Join(b.backupPath(app), "settings.json")))
+	statuses, err := b.Status()
+	Ok(t, err)
+	Equals(t, StateCopied, statuses[0].State)
+	Equals(t, StateCopied, statuses[1].State)
+
+	// a live change is pushed, a backup change is pulled.
+	err = afero.WriteFile(b.fs, zshrc, []byte("v2"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(b.backupPath(app), "settings.json"), []byte(`{"a":1}`), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(b.backupPath(app), "new.json"), []byte("new"), 0644)
+	Ok(t, err)
+	statuses, err = b.Status()
+	Ok(t, err)
+	Equals(t, StateOutOfSync, statuses[0].State)
+
+	plan, err := b.PlanSync()
+	Ok(t, err)
+	Equals(t, Plan{
+		{Type: ActionPut, Path: zshrc, Src: zshrc, Dst: "_HOME/.zshrc", Reason: "push", Replace: true},
+		{Type: ActionGet, Path: filepath.Join(app, "new.json"), Src: "_HOME/.config/app/new.json", Dst: filepath.Join(app, "new.json"), Reason: "pull"},
+		{Type: ActionGet, Path: filepath.Join(app, "settings.json"), Src: "_HOME/.config/app/settings.json", Dst: filepath.Join(app, "settings.json"), Reason: "pull", Replace: true},
+	}, plan)
+	err = b.Sync()
+	Ok(t, err)
+	Equals(t, "v2", readString(t, b.fs, b.backupPath(zshrc)))
+	Equals(t, `{"a":1}`, readString(t, b.fs, filepath.Join(app, "settings.json")))
+	Equals(t, "new", readString(t, b.fs, filepath.Join(app, "new.json")))
+
+	// deletions are propagated.
+	err = b.fs.Remove(filepath.Join(app, "new.json"))
+	Ok(t, err)
+	err = b.Sync()
+	Ok(t, err)
+	exists, err := afero.Exists(b.fs, filepath.Join(b.backupPath(app), "new.json"))
+	Ok(t, err)
+	Equals(t, false, exists)
+
+	// changes on both sides conflict and are left alone.
+	err = afero.WriteFile(b.fs, zshrc, []byte("local"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, b.backupPath(zshrc), []byte("remote"), 0644)
+	Ok(t, err)
+	err = b.Sync()
+	Equals(t, true, errors.Is(err, ErrSyncConflict))
+	checkFailedPaths(t, err, zshrc)
+	Equals(t, "local", readString(t, b.fs, zshrc))
+	Equals(t, "remote", readString(t, b.fs, b.backupPath(zshrc)))
+
+	// uninstall leaves copy mode paths alone, restore copies missing ones.
+	err = b.Uninstall()
+	Ok(t, err)
+	err = b.fs.RemoveAll(app)
+	Ok(t, err)
+	err = b.Restore()
+	Equals(t, true, errors.Is(err, ErrFileExists))
+	Equals(t, `{"a":1}`, readString(t, b.fs, filepath.Join(app, "settings.json")))
+}
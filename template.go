@@ -0,0 +1,162 @@
+package backedup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/afero"
+)
+
+// TemplateData is what templates of template paths are rendered with.
+type TemplateData struct {
+	// Hostname is the name of this host.
+	Hostname string
+	// OS and Arch are runtime.GOOS and runtime.GOARCH.
+	OS   string
+	Arch string
+	// User is the name of the current user.
+	User string
+	// Home is the home directory.
+	Home string
+	// Env are the environment variables.
+	Env map[string]string
+	// Vars are Config.Vars with the ones of the profile on top.
+	Vars map[string]string
+}
+
+// templateData returns the data templates are rendered with.
+func (b *Backedup) templateData() TemplateData {
+	data := TemplateData{
+		Hostname: b.hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		User:     os.Getenv("USER"),
+		Home:     b.homeDir,
+		Env:      map[string]string{},
+		Vars:     map[string]string{},
+	}
+	if u, err := user.Current(); err == nil {
+		data.User = u.Username
+	}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			data.Env[kv[:i]] = kv[i+1:]
+		}
+	}
+	for k, v := range b.Config.Vars {
+		data.Vars[k] = v
+	}
+	for k, v := range b.Config.Profiles[b.profile].Vars {
+		data.Vars[k] = v
+	}
+	return data
+}
+
+// render executes the template in the file src. Missing keys are an error
+// so a typo doesn't silently render an empty value.
+func (b *Backedup) render(src string) ([]byte, error) {
+	text, err := afero.ReadFile(b.fs, src)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(src)).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, b.templateData()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderTo renders the template src into dst, the file is swapped in at
+// once with the mode of the template.
+func (b *Backedup) renderTo(src, dst string) error {
+	data, err := b.render(src)
+	if err != nil {
+		return err
+	}
+	fi, err := b.fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.fs, dst, data, fi.Mode().Perm())
+}
+
+// rendered reports whether path has the content its template renders to.
+func (b *Backedup) rendered(path, backupPath string) (bool, error) {
+	data, err := b.render(backupPath)
+	if err != nil {
+		return false, err
+	}
+	current, err := afero.ReadFile(b.fs, path)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(data, current), nil
+}
+
+// planBackupTemplate copies a template path to the backup directory as the
+// first version of its template. Later changes are made to the template.
+func (b *Backedup) planBackupTemplate(plan *Plan, p PathConfig, fi os.FileInfo) bool {
+	path, backupPath := p.Path, b.backupPath(p.Path)
+	if !fi.Mode().IsRegular() {
+		plan.fail(path, fmt.Errorf("template %s is not a regular file", path))
+		return false
+	}
+	if _, err := b.fs.Lstat(backupPath); err == nil {
+		plan.skip(path, "template, edit it in the backup")
+		return true
+	}
+	if err := b.checkSecrets(p); err != nil {
+		plan.fail(path, err)
+		return false
+	}
+	plan.add(ActionCopy, path, path, backupPath)
+	return true
+}
+
+// planRestoreTemplate adds the actions that render a template path from
+// the backup, it returns false if the path failed or was left alone.
+func (b *Backedup) planRestoreTemplate(plan *Plan, p PathConfig, backupPath string) bool {
+	path := p.Path
+	if _, err := b.fs.Lstat(backupPath); err != nil {
+		if os.IsNotExist(err) && p.Optional {
+			plan.skip(path, "optional, not backed up")
+			return false
+		}
+		plan.fail(path, fmt.Errorf("backup path doesn't exist %s", backupPath))
+		return false
+	}
+	// render once to report template errors before anything changes.
+	if _, err := b.render(backupPath); err != nil {
+		plan.fail(path, err)
+		return false
+	}
+	fi, err := b.fs.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		plan.fail(path, err)
+		return false
+	}
+	if err == nil {
+		target := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, _ = b.fs.Readlink(path)
+		} else if ok, err := b.rendered(path, backupPath); err == nil && ok {
+			plan.skip(path, "up to date")
+			return true
+		}
+		if !b.planConflict(plan, p, target) {
+			return false
+		}
+	}
+	plan.add(ActionRender, path, backupPath, path)
+	return true
+}
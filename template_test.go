@@ -0,0 +1,67 @@
+package backedup
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestTemplate(t *testing.T) {
+	hostname, err := os.Hostname()
+	Ok(t, err)
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), fmt.Sprintf(`
+backup_to: %%[1]s/backedup
+vars:
+  email: me@home
+profiles:
+  work:
+    hosts: [%s]
+    vars:
+      email: me@work
+paths:
+  - path: $HOME/.gitconfig
+    template: true`, hostname))
+	defer cleanup()
+	gitconfig := b.Config.Paths[0].Path
+	err = afero.WriteFile(b.fs, gitconfig, []byte("email = me@home\n"), 0644)
+	Ok(t, err)
+
+	// backup copies the file as the first version of the template.
+	err = b.Backup()
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, gitconfig)
+	backupPath := b.backupPath(gitconfig)
+	err = afero.WriteFile(b.fs, backupPath, []byte("email = {{.Vars.email}}\nhost = {{.Hostname}}\n"), 0644)
+	Ok(t, err)
+	statuses, err := b.Status()
+	Ok(t, err)
+	Equals(t, StateDrifted, statuses[0].State)
+
+	// restore renders with the vars of the profile.
+	b.Config.Conflict = ConflictOverwrite
+	err = b.Restore()
+	Ok(t, err)
+	checkNotSymlink(t, b.fs, gitconfig)
+	Equals(t, fmt.Sprintf("email = me@work\nhost = %s\n", hostname), readString(t, b.fs, gitconfig))
+	statuses, err = b.Status()
+	Ok(t, err)
+	Equals(t, StateRendered, statuses[0].State)
+	plan, err := b.PlanRestore()
+	Ok(t, err)
+	Equals(t, Plan{{Type: ActionSkip, Path: gitconfig, Reason: "up to date"}}, plan)
+
+	err = afero.WriteFile(b.fs, gitconfig, []byte("edited\n"), 0644)
+	Ok(t, err)
+	statuses, err = b.Status()
+	Ok(t, err)
+	Equals(t, StateDrifted, statuses[0].State)
+
+	// template errors fail the path before anything changes.
+	err = afero.WriteFile(b.fs, backupPath, []byte("{{.Vars.missing}}"), 0644)
+	Ok(t, err)
+	err = b.Restore()
+	checkFailedPaths(t, err, gitconfig)
+	Equals(t, "edited\n", readString(t, b.fs, gitconfig))
+}
@@ -2,11 +2,11 @@ package backedup
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 
@@ -68,64 +68,47 @@ func initConfig(fs afero.Fs, stdin io.Reader, logger io.Writer, confPath string)
 	return nil
 }
 
-// FileCopy copies a single file from src to dst
-// From here https://blog.depado.eu/post/copy-files-and-directories-in-go
-func FileCopy(src, dst string) error {
-	var err error
-	var srcfd *os.File
-	var dstfd *os.File
-	var srcinfo os.FileInfo
-
-	if srcfd, err = os.Open(src); err != nil {
-		return err
-	}
-	defer srcfd.Close()
-
-	if dstfd, err = os.Create(dst); err != nil {
-		return err
+// promptConflict asks on stdin what to do with an existing file at path.
+// Anything but a known policy skips the path.
+func (b *Backedup) promptConflict(path string) (ConflictPolicy, error) {
+	fmt.Fprintf(b.logger, "%s exists, <skip|backup|overwrite>: ", path)
+	text, err := b.stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return ConflictSkip, err
 	}
-	defer dstfd.Close()
-
-	if _, err = io.Copy(dstfd, srcfd); err != nil {
-		return err
+	switch policy := ConflictPolicy(strings.TrimSpace(strings.ToLower(text))); policy {
+	case ConflictBackup, ConflictOverwrite:
+		return policy, nil
 	}
-	if srcinfo, err = os.Stat(src); err != nil {
-		return err
-	}
-	return os.Chmod(dst, srcinfo.Mode())
+	return ConflictSkip, nil
 }
 
-// DirCopy copies a whole directory recursively
-// From here https://blog.depado.eu/post/copy-files-and-directories-in-go
-func DirCopy(src string, dst string) error {
-	var err error
-	var fds []os.FileInfo
-	var srcinfo os.FileInfo
-
-	if srcinfo, err = os.Stat(src); err != nil {
-		return err
+// fileHash returns the hex encoded sha256 of the contents of path.
+func fileHash(fs FS, path string) (string, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
+	return readerHash(f)
+}
 
-	if err = os.MkdirAll(dst, srcinfo.Mode()); err != nil {
-		return err
+// readerHash returns the hex encoded sha256 of what r reads.
+func readerHash(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	if fds, err = ioutil.ReadDir(src); err != nil {
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it to path, so path is never partially written.
+func writeFileAtomic(fs FS, path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".backedup-tmp"
+	if err := afero.WriteFile(fs, tmpPath, data, perm); err != nil {
+		fs.Remove(tmpPath)
 		return err
 	}
-	for _, fd := range fds {
-		srcfp := path.Join(src, fd.Name())
-		dstfp := path.Join(dst, fd.Name())
-
-		if fd.IsDir() {
-			if err = DirCopy(srcfp, dstfp); err != nil {
-				fmt.Println(err)
-			}
-		} else {
-			if err = FileCopy(srcfp, dstfp); err != nil {
-				fmt.Println(err)
-			}
-		}
-	}
-	return nil
+	return fs.Rename(tmpPath, path)
 }
@@ -0,0 +1,290 @@
+package backedup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultDebounce is how long Watch waits after the last change of a burst.
+const DefaultDebounce = 2 * time.Second
+
+// WatchAction is what Watch does after a burst of changes.
+type WatchAction string
+
+const (
+	// WatchSync syncs copy mode paths, with backend git it commits too.
+	WatchSync WatchAction = "sync"
+	// WatchSnapshot takes a snapshot.
+	WatchSnapshot WatchAction = "snapshot"
+	// WatchCommit commits the backup directory, for backend git.
+	WatchCommit WatchAction = "commit"
+)
+
+// WatchConfig are the options of Watch.
+type WatchConfig struct {
+	// Debounce is a duration like 500ms, DefaultDebounce if empty.
+	Debounce string `json:"debounce,omitempty" yaml:"debounce,omitempty"`
+	// OnChange are the actions run in order after a burst of changes,
+	// WatchSync if empty.
+	OnChange []WatchAction `json:"on_change,omitempty" yaml:"on_change,omitempty"`
+}
+
+// validate returns an error for an invalid debounce or unknown actions.
+func (w WatchConfig) validate() error {
+	if _, err := w.debounce(); err != nil {
+		return err
+	}
+	for _, a := range w.OnChange {
+		switch a {
+		case WatchSync, WatchSnapshot, WatchCommit:
+		default:
+			return fmt.Errorf("unknown watch action %q", a)
+		}
+	}
+	return nil
+}
+
+// debounce returns the parsed Debounce.
+func (w WatchConfig) debounce() (time.Duration, error) {
+	if w.Debounce == "" {
+		return DefaultDebounce, nil
+	}
+	d, err := time.ParseDuration(w.Debounce)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid watch debounce %q", w.Debounce)
+	}
+	return d, nil
+}
+
+// Absorb moves files that replaced the symlink to their backup back to the
+// backup directory and links them again. Some applications save by writing
+// a new file over the symlink. The manifest is refreshed after, it also
+// records the edits made through the symlinks.
+func (b *Backedup) Absorb() error {
+	plan, err := b.PlanAbsorb()
+	if err != nil {
+		return err
+	}
+	err = b.run("absorb", plan)
+	if merr := b.writeManifest(); merr != nil && err == nil {
+		err = merr
+	}
+	return err
+}
+
+// PlanAbsorb returns the actions Absorb would take without changing
+// anything.
+func (b *Backedup) PlanAbsorb() (Plan, error) {
+	paths, err := b.resolvePaths(true, false)
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{}
+	for _, p := range paths {
+		if b.Config.mode(p) == ModeCopy || p.Template || p.Encrypt {
+			continue
+		}
+		backupPath := b.restorePath(p.Path)
+		fi, err := b.fs.Lstat(p.Path)
+		if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		files := []string{}
+		if fi.Mode().IsRegular() && !fi.IsDir() {
+			files = append(files, "")
+		} else if fi.IsDir() {
+			// linked entries aren't walked into, only replaced files are
+			// regular.
+			err := walkIgnore(b.fs, p.Path, b.excludes(p), func(rel string, info os.FileInfo, ignored bool) error {
+				if !ignored && info.Mode().IsRegular() {
+					files = append(files, filepath.FromSlash(rel))
+				}
+				return nil
+			})
+			if err != nil {
+				plan.fail(p.Path, err)
+				continue
+			}
+		}
+		for _, rel := range files {
+			live, backup := filepath.Join(p.Path, rel), filepath.Join(backupPath, rel)
+			if bfi, err := b.fs.Lstat(backup); err != nil || !bfi.Mode().IsRegular() {
+				continue
+			}
+			plan = append(plan, Action{Type: ActionCopy, Path: p.Path, Src: live, Dst: backup, Replace: true})
+			plan.add(ActionRemove, p.Path, "", live)
+			plan.add(ActionSymlink, p.Path, backup, live)
+		}
+	}
+	return plan, nil
+}
+
+// watchPaths returns the directories Watch adds: the backup directory and
+// the directories of copy mode paths with everything under them, and the
+// directories containing configured paths.
+func (b *Backedup) watchPaths(paths []PathConfig) ([]string, error) {
+	dirs := []string{}
+	seen := map[string]bool{}
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	addTree := func(root string, m *ignoreMatcher) error {
+		add(root)
+		return walkIgnore(b.fs, root, m, func(rel string, info os.FileInfo, ignored bool) error {
+			if !ignored && info.IsDir() {
+				add(filepath.Join(root, filepath.FromSlash(rel)))
+			}
+			return nil
+		})
+	}
+	if err := addTree(b.Config.BackupTo, internalMatcher()); err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		if _, err := b.fs.Stat(filepath.Dir(p.Path)); err == nil {
+			add(filepath.Dir(p.Path))
+		}
+		if fi, err := b.fs.Lstat(p.Path); err == nil && fi.IsDir() && b.Config.mode(p) == ModeCopy {
+			if err := addTree(p.Path, b.excludes(p)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// watched reports whether a change of name belongs to the backup directory
+// or a configured path.
+func (b *Backedup) watched(name string, paths []PathConfig) bool {
+	if strings.HasSuffix(name, ".backedup-tmp") {
+		return false
+	}
+	if rel, err := filepath.Rel(b.Config.BackupTo, name); err == nil && !strings.HasPrefix(rel, "..") {
+		fi, err := b.fs.Lstat(name)
+		return !internalMatcher().match(filepath.ToSlash(rel), err == nil && fi.IsDir())
+	}
+	for _, p := range paths {
+		if name == p.Path || strings.HasPrefix(name, p.Path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch watches the backup directory and the configured paths until ctx is
+// done. After every burst of changes, once nothing changed for the
+// debounce, replaced symlinks are absorbed and Config.Watch.OnChange runs.
+// The watches need the files on disk, it doesn't work on NewMemFs.
+func (b *Backedup) Watch(ctx context.Context) error {
+	debounce, err := b.Config.Watch.debounce()
+	if err != nil {
+		return err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	paths, err := b.resolvePaths(true, true)
+	if err != nil {
+		return err
+	}
+	if err := b.addWatches(w, paths); err != nil {
+		return err
+	}
+	fmt.Fprintf(b.logger, "INFO: watching %s and %d paths\n", b.Config.BackupTo, len(paths))
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(b.logger, "WARN: watch %s\n", err)
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if !b.watched(ev.Name, paths) {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				// new directories are watched at once so the rest of the burst
+				// isn't missed.
+				if fi, err := b.fs.Lstat(ev.Name); err == nil && fi.IsDir() {
+					if err := w.Add(ev.Name); err != nil {
+						fmt.Fprintf(b.logger, "WARN: watch %s %s\n", ev.Name, err)
+					}
+				}
+			}
+			timer.Reset(debounce)
+		case <-timer.C:
+			b.onChange()
+			// paths and directories may have come and gone.
+			if paths, err = b.resolvePaths(true, true); err != nil {
+				return err
+			}
+			if err := b.addWatches(w, paths); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// addWatches adds the directories of watchPaths to w.
+func (b *Backedup) addWatches(w *fsnotify.Watcher, paths []PathConfig) error {
+	dirs, err := b.watchPaths(paths)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			return fmt.Errorf("watch %s %s", dir, err)
+		}
+	}
+	return nil
+}
+
+// onChange absorbs replaced symlinks and runs Config.Watch.OnChange, errors
+// are logged.
+func (b *Backedup) onChange() {
+	if err := b.Absorb(); err != nil {
+		fmt.Fprintf(b.logger, "ERRO: absorb %s\n", err)
+	}
+	actions := b.Config.Watch.OnChange
+	if len(actions) == 0 {
+		actions = []WatchAction{WatchSync}
+	}
+	for _, a := range actions {
+		var err error
+		switch a {
+		case WatchSync:
+			err = b.Sync()
+		case WatchSnapshot:
+			var s Snapshot
+			if s, err = b.Snapshot(); err == nil {
+				fmt.Fprintf(b.logger, "INFO: snapshot %s\n", s.ID)
+			}
+		case WatchCommit:
+			var committed bool
+			if committed, err = b.Commit(); err == nil && committed {
+				fmt.Fprintf(b.logger, "INFO: committed\n")
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(b.logger, "ERRO: %s %s\n", a, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package backedup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestPlanAbsorb(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: %[1]s/backedup
+paths:
+  - $HOME/.zshrc
+  - path: $HOME/.config/app
+    mode: link-files`)
+	defer cleanup()
+	zshrc, app := b.Config.Paths[0].Path, b.Config.Paths[1].Path
+	err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(app, "a.conf"), []byte("a"), 0644)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, filepath.Join(app, "b.conf"), []byte("b"), 0644)
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+	plan, err := b.PlanAbsorb()
+	Ok(t, err)
+	Equals(t, Plan{}, plan)
+
+	// saved over the symlinks.
+	for _, path := range []string{zshrc, filepath.Join(app, "b.conf")} {
+		err = b.fs.Remove(path)
+		Ok(t, err)
+		err = afero.WriteFile(b.fs, path, []byte("v2"), 0644)
+		Ok(t, err)
+	}
+	err = b.Absorb()
+	Ok(t, err)
+	checkNewSymlink(t, b.fs, zshrc)
+	Equals(t, "v2", readString(t, b.fs, b.backupPath(zshrc)))
+	checkNewSymlink(t, b.fs, filepath.Join(app, "b.conf"))
+	Equals(t, "v2", readString(t, b.fs, filepath.Join(b.backupPath(app), "b.conf")))
+	Equals(t, "a", readString(t, b.fs, filepath.Join(app, "a.conf")))
+}
+
+func TestWatch(t *testing.T) {
+	b, _, cleanup := newTestBackedup(t, NewOsFs(), `
+backup_to: %[1]s/backedup
+watch:
+  debounce: 50ms
+paths:
+  - $HOME/.zshrc
+  - path: $HOME/.config/Code/settings.json
+    mode: copy`)
+	defer cleanup()
+	zshrc, settings := b.Config.Paths[0].Path, b.Config.Paths[1].Path
+	err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0644)
+	Ok(t, err)
+	err = b.fs.MkdirAll(filepath.Dir(settings), 0755)
+	Ok(t, err)
+	err = afero.WriteFile(b.fs, settings, []byte("{}"), 0644)
+	Ok(t, err)
+	err = b.Backup()
+	Ok(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Watch(ctx) }()
+	// give the watches time to be added.
+	time.Sleep(100 * time.Millisecond)
+
+	err = afero.WriteFile(b.fs, settings, []byte(`{"a":1}`), 0644)
+	Ok(t, err)
+	// saved by writing a new file over the symlink.
+	tmp := zshrc + ".new"
+	err = afero.WriteFile(b.fs, tmp, []byte("v2"), 0644)
+	Ok(t, err)
+	err = os.Rename(tmp, zshrc)
+	Ok(t, err)
+	waitFor(t, func() bool {
+		target, err := b.fs.Readlink(zshrc)
+		return err == nil && target == b.backupPath(zshrc) &&
+			readString(t, b.fs, b.backupPath(settings)) == `{"a":1}`
+	})
+	Equals(t, "v2", readString(t, b.fs, b.backupPath(zshrc)))
+
+	cancel()
+	Ok(t, <-done)
+}
+
+// waitFor polls cond until it is true or fails the test after 5 seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
@@ -0,0 +1,338 @@
+package backedup
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// StorageWebDAV is the storage type of a WebDAV server like Nextcloud,
+	// selected by a backup_to like webdav://user@host/path.
+	StorageWebDAV = "webdav"
+	// WebDAVPasswordEnv is the environment variable with the password of
+	// the WebDAV user.
+	WebDAVPasswordEnv = "BACKEDUP_WEBDAV_PASSWORD"
+	// davNS is the namespace of the properties backedup sets.
+	davNS = "https://github.com/pkar/backedup"
+)
+
+// webdavStorage is a Storage on a WebDAV server. Modes, mtimes and symlink
+// targets are kept as properties, servers without them restore files as
+// 0644.
+type webdavStorage struct {
+	client   *http.Client
+	base     *url.URL
+	user     string
+	password string
+	// dirs are the collections known to exist.
+	dirs map[string]bool
+}
+
+// openWebDAVStorage opens the storage of a backup_to like
+// webdav://user@host/path. It is reached over https unless the scheme
+// option is http, the password is WebDAVPasswordEnv.
+func openWebDAVStorage(c StorageConfig, fs FS, backupTo string) (Storage, error) {
+	u, err := url.Parse(backupTo)
+	if err != nil || u.Scheme != StorageWebDAV || u.Host == "" {
+		return nil, fmt.Errorf("backup_to %s is not webdav://host/path", backupTo)
+	}
+	s := &webdavStorage{
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		base:     &url.URL{Scheme: "https", Host: u.Host, Path: strings.TrimSuffix(u.Path, "/")},
+		password: os.Getenv(WebDAVPasswordEnv),
+		dirs:     map[string]bool{},
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+	}
+	switch scheme := c.Options["scheme"]; scheme {
+	case "", "https":
+	case "http":
+		s.base.Scheme = scheme
+	default:
+		return nil, fmt.Errorf("invalid webdav scheme %q", scheme)
+	}
+	return s, nil
+}
+
+// url returns the URL of key, of the base collection if key is empty.
+func (s *webdavStorage) url(key string) string {
+	u := *s.base
+	u.Path = path.Join(u.Path, key)
+	if key == "" {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+// do sends a request for key and returns the response if its status is one
+// of ok. A missing key is an error for which os.IsNotExist is true.
+func (s *webdavStorage) do(method, key string, header http.Header, body []byte, ok ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+	return nil, fmt.Errorf("webdav %s %s %s", method, key, resp.Status)
+}
+
+// mkcol creates the collection dir and the ones it is in up to the base
+// path unless they are known to exist. The base path is created as well,
+// the collection it is in has to exist.
+func (s *webdavStorage) mkcol(dir string) error {
+	if dir == "." {
+		dir = ""
+	}
+	if s.dirs[dir] {
+		return nil
+	}
+	if dir != "" {
+		if err := s.mkcol(path.Dir(dir)); err != nil {
+			return err
+		}
+	}
+	// 405 is the answer for a collection that exists.
+	resp, err := s.do("MKCOL", dir+"/", nil, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	s.dirs[dir] = true
+	return nil
+}
+
+// Put implements Storage, the collections of the key are created first.
+func (s *webdavStorage) Put(info ObjectInfo, r io.Reader) error {
+	if info.Mode.IsDir() {
+		if err := s.mkcol(info.Key); err != nil {
+			return err
+		}
+		return s.proppatch(info)
+	}
+	if err := s.mkcol(path.Dir(info.Key)); err != nil {
+		return err
+	}
+	var data []byte
+	if r != nil && info.Target == "" {
+		var err error
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	resp, err := s.do(http.MethodPut, info.Key, nil, data, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.proppatch(info)
+}
+
+// proppatch sets the mode, mtime and target of info as properties of its
+// key. Servers that don't keep them aren't an error.
+func (s *webdavStorage) proppatch(info ObjectInfo) error {
+	mtime := info.ModTime
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	var props bytes.Buffer
+	fmt.Fprintf(&props, "<b:mode>%o</b:mode><b:mtime>%s</b:mtime>", info.Mode.Perm(), mtime.UTC().Format(time.RFC3339Nano))
+	if info.Target != "" {
+		props.WriteString("<b:target>")
+		xml.EscapeText(&props, []byte(info.Target))
+		props.WriteString("</b:target>")
+	}
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?><D:propertyupdate xmlns:D="DAV:" xmlns:b="%s"><D:set><D:prop>%s</D:prop></D:set></D:propertyupdate>`, davNS, props.String())
+	header := http.Header{"Content-Type": {"application/xml; charset=utf-8"}}
+	key := info.Key
+	if info.Mode.IsDir() {
+		key += "/"
+	}
+	resp, err := s.do("PROPPATCH", key, header, []byte(body), http.StatusMultiStatus, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Get implements Storage.
+func (s *webdavStorage) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Stat implements Storage.
+func (s *webdavStorage) Stat(key string) (ObjectInfo, error) {
+	objects, err := s.propfind(key, "0")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if len(objects) == 0 {
+		return ObjectInfo{}, &os.PathError{Op: "stat", Path: key, Err: os.ErrNotExist}
+	}
+	return objects[0], nil
+}
+
+// List walks the collections one level at a time, many servers don't
+// allow PROPFIND with infinite depth.
+func (s *webdavStorage) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	todo := []string{prefix}
+	for len(todo) > 0 {
+		key := todo[0]
+		todo = todo[1:]
+		entries, err := s.propfind(key, "1")
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range entries {
+			if o.Key == key {
+				if !o.Mode.IsDir() {
+					objects = append(objects, o)
+				}
+				continue
+			}
+			objects = append(objects, o)
+			if o.Mode.IsDir() {
+				todo = append(todo, o.Key)
+			}
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Delete implements Storage.
+func (s *webdavStorage) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Lock puts a lock file unless there is one. Two runs starting at the same
+// moment can both get it.
+func (s *webdavStorage) Lock() (func() error, error) {
+	if _, err := s.Stat(lockKey); err == nil {
+		return nil, fmt.Errorf("%w, delete %s if no other run is going on", ErrLocked, s.url(lockKey))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s %d %s\n", hostname, os.Getpid(), time.Now().Format(time.RFC3339))
+	if err := s.Put(ObjectInfo{Key: lockKey, Mode: 0644}, strings.NewReader(owner)); err != nil {
+		return nil, err
+	}
+	return func() error { return s.Delete(lockKey) }, nil
+}
+
+// davMultistatus is the response of a PROPFIND.
+type davMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ETag          string `xml:"DAV: getetag"`
+				Mode          string `xml:"https://github.com/pkar/backedup mode"`
+				MTime         string `xml:"https://github.com/pkar/backedup mtime"`
+				Target        string `xml:"https://github.com/pkar/backedup target"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfindBody asks for the properties ObjectInfo needs.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:" xmlns:b="` + davNS + `"><D:prop>` +
+	`<D:resourcetype/><D:getcontentlength/><D:getlastmodified/><D:getetag/><b:mode/><b:mtime/><b:target/>` +
+	`</D:prop></D:propfind>`
+
+// propfind returns key and, with depth 1, what is in it.
+func (s *webdavStorage) propfind(key, depth string) ([]ObjectInfo, error) {
+	header := http.Header{"Depth": {depth}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := s.do("PROPFIND", key, header, []byte(propfindBody), http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav PROPFIND %s %s", key, err)
+	}
+	objects := []ObjectInfo{}
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("webdav PROPFIND %s %s", key, err)
+		}
+		rel := strings.TrimPrefix(href.Path, s.base.Path)
+		if rel == href.Path && s.base.Path != "" {
+			continue
+		}
+		info := ObjectInfo{Key: strings.Trim(rel, "/"), Mode: 0644}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200") {
+				continue
+			}
+			p := ps.Prop
+			if p.ResourceType.Collection != nil {
+				info.Mode = os.ModeDir | 0755
+			}
+			info.Size, _ = strconv.ParseInt(p.ContentLength, 10, 64)
+			info.ModTime, _ = http.ParseTime(p.LastModified)
+			info.ETag = p.ETag
+			if mode, err := strconv.ParseUint(p.Mode, 8, 32); err == nil {
+				info.Mode = info.Mode&os.ModeDir | os.FileMode(mode).Perm()
+			}
+			if mtime, err := time.Parse(time.RFC3339Nano, p.MTime); err == nil {
+				info.ModTime = mtime
+			}
+			if p.Target != "" {
+				info.Target = p.Target
+				info.Mode |= os.ModeSymlink
+			}
+		}
+		objects = append(objects, info)
+	}
+	return objects, nil
+}
@@ -0,0 +1,111 @@
+package backedup
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/webdav"
+)
+
+// fakeWebDAV serves a WebDAV server in memory under /dav for the user me
+// with the password secret, counting the downloads of backed up files.
+type fakeWebDAV struct {
+	handler *webdav.Handler
+	gets    int32
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); !ok || user != "me" || password != "secret" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dav"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/_HOME/") {
+		atomic.AddInt32(&f.gets, 1)
+	}
+	f.handler.ServeHTTP(w, r)
+}
+
+func TestWebDAVStorage(t *testing.T) {
+	fake := &fakeWebDAV{handler: &webdav.Handler{Prefix: "/dav", FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	defer os.Setenv(WebDAVPasswordEnv, os.Getenv(WebDAVPasswordEnv))
+	os.Setenv(WebDAVPasswordEnv, "secret")
+	b, _, cleanup := newTestBackedup(t, NewMemFs(), `
+backup_to: webdav://me@`+strings.TrimPrefix(srv.URL, "http://")+`/dav/laptop
+catalog: %[1]s/catalog
+mode: copy
+storage:
+  options:
+    scheme: http
+paths:
+  - $HOME/.zshrc
+  - $HOME/.config/app`)
+	defer cleanup()
+	zshrc, app := b.Config.Paths[0].Path, b.Config.Paths[1].Path
+	err := afero.WriteFile(b.fs, zshrc, []byte("v1"), 0600)
+	Ok(t, err)
+	for _, name := range []string{"a.json", "sub/b.json"} {
+		err = afero.WriteFile(b.fs, filepath.Join(app, name), []byte(name), 0644)
+		Ok(t, err)
+	}
+
+	err = b.Backup()
+	Ok(t, err)
+	data, err := b.readObject("_HOME/.zshrc")
+	Ok(t, err)
+	Equals(t, "v1", string(data))
+	info, err := b.storage.Stat("_HOME/.zshrc")
+	Ok(t, err)
+	Equals(t, os.FileMode(0600), info.Mode)
+	Equals(t, true, info.ETag != "")
+	objects, err := b.storage.List("_HOME/.config")
+	Ok(t, err)
+	keys := []string{}
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	Equals(t, []string{"_HOME/.config/app", "_HOME/.config/app/a.json", "_HOME/.config/app/sub", "_HOME/.config/app/sub/b.json"}, keys)
+	_, err = b.storage.Stat(lockKey)
+	Equals(t, true, os.IsNotExist(err))
+
+	// unchanged ETags don't download the files again.
+	atomic.StoreInt32(&fake.gets, 0)
+	err = b.Sync()
+	Ok(t, err)
+	Equals(t, int32(0), atomic.LoadInt32(&fake.gets))
+
+	err = b.storage.Put(ObjectInfo{Key: "_HOME/.config/app/sub/b.json", Mode: 0644}, strings.NewReader("changed"))
+	Ok(t, err)
+	err = b.Sync()
+	Ok(t, err)
+	Equals(t, "changed", readString(t, b.fs, filepath.Join(app, "sub", "b.json")))
+
+	err = b.fs.Remove(zshrc)
+	Ok(t, err)
+	err = b.Restore()
+	Ok(t, err)
+	Equals(t, "v1", readString(t, b.fs, zshrc))
+	fi, err := b.fs.Stat(zshrc)
+	Ok(t, err)
+	Equals(t, os.FileMode(0600), fi.Mode().Perm())
+
+	err = b.storage.Put(ObjectInfo{Key: lockKey, Mode: 0644}, strings.NewReader("other"))
+	Ok(t, err)
+	err = b.Sync()
+	Equals(t, true, errors.Is(err, ErrLocked))
+
+	os.Setenv(WebDAVPasswordEnv, "wrong")
+	s, err := openWebDAVStorage(b.Config.Storage, b.fs, b.Config.remote)
+	Ok(t, err)
+	_, err = s.Stat("_HOME/.zshrc")
+	Equals(t, true, err != nil && !os.IsNotExist(err))
+}